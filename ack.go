@@ -0,0 +1,29 @@
+package mista
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+// how long we give an acknowledgement call to Mista
+const ackTimeout = 10 * time.Second
+
+// ackMsg tells Mista we've received the inbound message with the passed in ID so it can let the sender know. This is
+// done in the background so that it doesn't hold up our response to Mista, failures only being logged.
+func (h *handler) ackMsg(channel courier.Channel, externalID string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+		defer cancel()
+
+		url := endpointURL(channel, endpointAck, map[string]string{"uid": externalID})
+		payload := map[string]string{"status": channel.StringConfigForKey(configAckStatus, defaultAckStatus)}
+
+		if err := h.callAPI(ctx, channel, http.MethodPost, url, payload, nil); err != nil {
+			logrus.WithField("channel_uuid", channel.UUID().String()).WithField("external_id", externalID).WithError(err).Error("error acknowledging message")
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package mista
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/nyaruka/courier"
+)
+
+// callAPI makes a JSON request to the Mista API for the passed in channel, decoding a successful response into the
+// given response, which may be nil if we don't care about the response
+func (h *handler) callAPI(ctx context.Context, channel courier.Channel, method string, url string, payload interface{}, response interface{}) error {
+	// like sends, these requests carry our API key so must never go anywhere unexpected
+	if err := validateSendURL(url, channel.BoolConfigForKey(configInsecure, false)); err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if payload != nil {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(marshalled)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+channel.StringConfigForKey(courier.ConfigAPIKey, ""))
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client, err := h.clientForChannel(channel)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return &apiError{statusCode: resp.StatusCode, body: string(respBody)}
+	}
+
+	if response != nil {
+		if err := json.Unmarshal(respBody, response); err != nil {
+			return fmt.Errorf("unable to parse response: %w", err)
+		}
+	}
+	return nil
+}
+
+// apiError is returned when the Mista API responds to a request with a non-success status code
+type apiError struct {
+	statusCode int
+	body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("request failed with status code: %d", e.statusCode)
+}
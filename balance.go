@@ -0,0 +1,109 @@
+package mista
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+// how often we fetch the balance of channels with a low balance threshold, and how long we give each fetch
+var balanceCheckInterval = time.Hour
+
+const balanceCheckTimeout = 30 * time.Second
+
+// FetchBalance fetches the current account balance for the passed in channel from Mista, alerting if it's low
+func (h *handler) FetchBalance(ctx context.Context, channel courier.Channel) (float64, error) {
+	var response struct {
+		Balance *float64 `json:"balance"`
+	}
+	if err := h.callAPI(ctx, channel, http.MethodGet, endpointURL(channel, endpointBalance, nil), nil, &response); err != nil {
+		return 0, fmt.Errorf("error fetching balance: %w", err)
+	}
+	if response.Balance == nil {
+		return 0, fmt.Errorf("balance response missing balance")
+	}
+
+	if alert := h.checkBalance(channel, *response.Balance); alert != nil {
+		if err := h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{alert}); err != nil {
+			logrus.WithField("channel_uuid", channel.UUID().String()).WithError(err).Error("error writing low balance log")
+		}
+	}
+	return *response.Balance, nil
+}
+
+// watchBalance starts fetching the balance of the passed in channel every interval if it has a low balance threshold,
+// so that it's checked even while nothing is being sent. We aren't told about channels until they're used, so checks
+// start the first time a channel sends, and each uses the last version of the channel's config we've seen.
+func (h *handler) watchBalance(channel courier.Channel) {
+	if _, hasThreshold := floatConfigForKey(channel, configLowBalanceThreshold); !hasThreshold {
+		return
+	}
+
+	key := channel.UUID().String()
+	if _, watching := h.balanceWatches.LoadOrStore(key, channel); watching {
+		h.balanceWatches.Store(key, channel)
+		return
+	}
+
+	s := h.Server()
+	s.WaitGroup().Add(1)
+	interval := balanceCheckInterval
+
+	go func() {
+		defer s.WaitGroup().Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.StopChan():
+				return
+			case <-ticker.C:
+				latest, _ := h.balanceWatches.Load(key)
+				channel := latest.(courier.Channel)
+				if _, hasThreshold := floatConfigForKey(channel, configLowBalanceThreshold); !hasThreshold {
+					continue
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), balanceCheckTimeout)
+				if _, err := h.FetchBalance(ctx, channel); err != nil {
+					logrus.WithField("channel_uuid", key).WithError(err).Warn("error checking Mista balance")
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// checkBalance alerts operators once when the passed in balance for a channel falls below its configured threshold,
+// returning the alert as a channel log, or nil if no alert is needed. We don't alert again until the balance has been
+// topped up above the threshold.
+func (h *handler) checkBalance(channel courier.Channel, balance float64) *courier.ChannelLog {
+	threshold, hasThreshold := floatConfigForKey(channel, configLowBalanceThreshold)
+	if !hasThreshold {
+		return nil
+	}
+
+	key := channel.UUID().String()
+	if balance >= threshold {
+		h.lowBalances.Delete(key)
+		return nil
+	}
+	if _, alerted := h.lowBalances.LoadOrStore(key, time.Now()); alerted {
+		return nil
+	}
+
+	err := fmt.Errorf("account balance %.2f is below the alert threshold of %.2f", balance, threshold)
+	logrus.WithFields(logrus.Fields{
+		"channel_uuid": key,
+		"balance":      balance,
+		"threshold":    threshold,
+	}).Warn("Mista account balance is low")
+
+	return courier.NewChannelLogFromError("Low Balance", channel, courier.NilMsgID, 0, err)
+}
@@ -0,0 +1,31 @@
+package mista
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/nyaruka/courier"
+)
+
+// CancelMsg cancels the scheduled message with the passed in UID before Mista sends it, such as when a one-time code
+// has been superseded, and marks the message as failed
+func (h *handler) CancelMsg(ctx context.Context, channel courier.Channel, uid string) (courier.MsgStatus, error) {
+	if uid == "" {
+		return nil, errors.New("can't cancel message without a UID")
+	}
+
+	url := endpointURL(channel, endpointCancel, map[string]string{"uid": uid})
+	if err := h.callAPI(ctx, channel, http.MethodPost, url, nil, nil); err != nil {
+		return nil, fmt.Errorf("error cancelling message: %w", err)
+	}
+
+	status := h.Backend().NewMsgStatusForExternalID(channel, uid, courier.MsgFailed)
+	status.AddLog(courier.NewChannelLogFromError("Message Cancelled", channel, courier.NilMsgID, 0, errors.New("cancelled before sending")))
+
+	if err := h.Backend().WriteMsgStatus(ctx, status); err != nil {
+		return nil, fmt.Errorf("error writing cancelled status: %w", err)
+	}
+	return status, nil
+}
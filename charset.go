@@ -0,0 +1,73 @@
+package mista
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// decodeBody converts an inbound body delivered in the passed in encoding to UTF-8
+func decodeBody(body string, encoding string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "utf8", "utf-8", "text", "plain", "gsm", "gsm7", "0":
+		return body, nil
+
+	// 8 is the SMPP data coding for UCS-2
+	case "ucs2", "ucs-2", "utf16", "utf-16", "utf-16be", "unicode", "8":
+		return decodeUCS2Hex(body)
+
+	case "latin1", "latin-1", "iso-8859-1":
+		runes := make([]rune, len(body))
+		for i := 0; i < len(body); i++ {
+			runes[i] = rune(body[i])
+		}
+		return string(runes), nil
+	}
+
+	return "", fmt.Errorf("unsupported encoding '%s'", encoding)
+}
+
+// decodeUCS2Hex decodes a hex encoded big endian UTF-16 body, which is how UCS-2 messages are delivered from handsets
+func decodeUCS2Hex(body string) (string, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(body))
+	if err != nil {
+		return "", fmt.Errorf("invalid UCS-2 hex body: %w", err)
+	}
+	if len(raw)%2 != 0 {
+		return "", fmt.Errorf("invalid UCS-2 hex body: odd number of bytes")
+	}
+
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(raw[i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// unencodableChars returns the characters in the passed in text which can't be sent as UCS-2. Characters outside of
+// the basic multilingual plane, like emoji, are sent as surrogate pairs just as we count them when working out
+// segments, so that only leaves invalid UTF-8 and Unicode noncharacters, which networks are free to drop.
+func unencodableChars(text string) []string {
+	chars := make([]string, 0)
+	for i, r := range text {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(text[i:]); size <= 1 {
+				chars = append(chars, fmt.Sprintf("%q", text[i:i+1]))
+				continue
+			}
+		}
+		if isNoncharacter(r) {
+			chars = append(chars, fmt.Sprintf("%q (U+%04X)", r, r))
+		}
+	}
+	return chars
+}
+
+// isNoncharacter returns whether the passed in rune is one of the code points Unicode reserves as noncharacters, which
+// are U+FDD0 to U+FDEF and the last two code points of every plane
+func isNoncharacter(r rune) bool {
+	return (r >= 0xFDD0 && r <= 0xFDEF) || r&0xFFFE == 0xFFFE
+}
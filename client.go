@@ -0,0 +1,217 @@
+package mista
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+// defaults for our transport settings, in seconds
+const (
+	defaultIdleConnTimeout = 90
+	defaultMaxConnLifetime = 0
+)
+
+// the TLS versions which can be configured as the minimum for a channel
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// transportConfig is the transport settings for a channel's send client
+type transportConfig struct {
+	idleConnTimeout time.Duration
+	maxConnLifetime time.Duration
+	tlsMinVersion   uint16
+	cipherSuites    []uint16
+	timeout         time.Duration
+	publicOnly      bool
+}
+
+// transportConfigForChannel reads the transport settings for the passed in channel, returning an error if they aren't
+// valid
+func transportConfigForChannel(channel courier.Channel) (*transportConfig, error) {
+	config := &transportConfig{
+		idleConnTimeout: time.Duration(channel.IntConfigForKey(configIdleConnTimeout, defaultIdleConnTimeout)) * time.Second,
+		maxConnLifetime: time.Duration(channel.IntConfigForKey(configMaxConnLifetime, defaultMaxConnLifetime)) * time.Second,
+	}
+
+	// without a minimum TLS version we leave it to Go's default
+	if minVersion := channel.StringConfigForKey(configTLSMinVersion, ""); minVersion != "" {
+		version, found := tlsVersions[minVersion]
+		if !found {
+			return nil, fmt.Errorf("invalid TLS minimum version '%s', must be one of '1.0', '1.1', '1.2' or '1.3'", minVersion)
+		}
+		config.tlsMinVersion = version
+	}
+
+	// without cipher suites we leave it to Go's secure defaults, and we never allow any which Go considers insecure.
+	// Note these only restrict TLS 1.2 and below as Go doesn't allow TLS 1.3 suites to be configured.
+	for _, name := range stringListConfigForKey(channel, configTLSCipherSuites) {
+		id, found := secureCipherSuite(name)
+		if !found {
+			return nil, fmt.Errorf("unsupported TLS cipher suite '%s'", name)
+		}
+		config.cipherSuites = append(config.cipherSuites, id)
+	}
+	return config, nil
+}
+
+// secureCipherSuite returns the ID of the secure cipher suite with the passed in name
+func secureCipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// key returns a key which changes whenever these settings do
+func (c *transportConfig) key() string {
+	return fmt.Sprintf("%s|%s|%d|%v|%s|%t", c.idleConnTimeout, c.maxConnLifetime, c.tlsMinVersion, c.cipherSuites, c.timeout, c.publicOnly)
+}
+
+// newTransport creates a new transport with these settings
+func (c *transportConfig) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.IdleConnTimeout = c.idleConnTimeout
+	if c.tlsMinVersion != 0 || len(c.cipherSuites) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.MinVersion = c.tlsMinVersion
+		transport.TLSClientConfig.CipherSuites = c.cipherSuites
+	}
+
+	// clients for URLs we're given rather than Mista's own can only connect to public addresses, which we check as we
+	// dial so that redirects and DNS can't get around it, and without a proxy as then we'd only see the proxy's address
+	if c.publicOnly {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicOnlyControl}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+	return transport
+}
+
+// publicOnlyControl refuses connections to any address which isn't on the public internet
+func publicOnlyControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// httpClient is what we make requests to Mista with
+type httpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// clientFactory creates the HTTP client for a channel with the passed in transport settings
+type clientFactory func(config *transportConfig) httpClient
+
+// defaultClientFactory creates pooled send clients
+func defaultClientFactory(config *transportConfig) httpClient {
+	return newSendClient(config)
+}
+
+// sendClient is the HTTP client for a channel, which when the channel has a maximum connection lifetime, swaps in a
+// new transport once that's elapsed so that no connection outlives it by more than the length of a request
+type sendClient struct {
+	config *transportConfig
+
+	mutex   sync.Mutex
+	client  *http.Client
+	created time.Time
+}
+
+func newSendClient(config *transportConfig) *sendClient {
+	return &sendClient{
+		config:  config,
+		client:  &http.Client{Transport: config.newTransport(), Timeout: config.timeout},
+		created: time.Now(),
+	}
+}
+
+// Do sends the passed in request
+func (c *sendClient) Do(req *http.Request) (*http.Response, error) {
+	c.mutex.Lock()
+	if c.config.maxConnLifetime > 0 && time.Since(c.created) > c.config.maxConnLifetime {
+		expired := c.client
+		c.client = &http.Client{Transport: c.config.newTransport(), Timeout: c.config.timeout}
+		c.created = time.Now()
+
+		// requests in flight on the old transport can finish, after which its connections sit idle until timed out
+		expired.CloseIdleConnections()
+	}
+	client := c.client
+	c.mutex.Unlock()
+
+	return client.Do(req)
+}
+
+// clientForChannel returns the send client for the passed in channel, creating a new one if its settings have changed
+func (h *handler) clientForChannel(channel courier.Channel) (httpClient, error) {
+	config, err := transportConfigForChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+	return h.clientForConfig(channel, config), nil
+}
+
+// clientForConfig returns the client for the passed in channel with the given transport settings
+func (h *handler) clientForConfig(channel courier.Channel, config *transportConfig) httpClient {
+	key := channel.UUID().String() + "|" + config.key()
+
+	if client, found := h.clients.Load(key); found {
+		return client.(httpClient)
+	}
+
+	client, _ := h.clients.LoadOrStore(key, h.newClient(config))
+	return client.(httpClient)
+}
+
+// checkTransportConfig validates the transport settings of the passed in channel as soon as we see its config, rather
+// than leaving them to fail its sends later, writing a channel log the first time we see each invalid setting
+func (h *handler) checkTransportConfig(ctx context.Context, channel courier.Channel) {
+	key := channel.UUID().String()
+
+	_, err := transportConfigForChannel(channel)
+	if err == nil {
+		h.invalidTransports.Delete(key)
+		return
+	}
+	if previous, found := h.invalidTransports.Load(key); found && previous.(string) == err.Error() {
+		return
+	}
+	h.invalidTransports.Store(key, err.Error())
+
+	log := courier.NewChannelLogFromError("Invalid Transport Config", channel, courier.NilMsgID, 0, err)
+	if err := h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log}); err != nil {
+		logrus.WithField("channel_uuid", key).WithError(err).Error("error writing invalid transport config log")
+	}
+}
+
+// withTransportCheck wraps the passed in route handler so that channel transport settings are validated whenever we
+// receive something for a channel, which is often well before it sends anything
+func (h *handler) withTransportCheck(fn courier.ChannelHandleFunc) courier.ChannelHandleFunc {
+	return func(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+		h.checkTransportConfig(ctx, channel)
+		return fn(ctx, channel, w, r)
+	}
+}
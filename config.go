@@ -0,0 +1,189 @@
+package mista
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// configCache caches the values we derive from channel config so that hot paths don't parse the same config on every
+// send. Entries are keyed by channel UUID and config key, and remember the source of the raw config they were derived
+// from so that they're derived again as soon as that config changes.
+type configCache struct {
+	entries sync.Map
+}
+
+type cachedConfig struct {
+	source string
+	value  interface{}
+}
+
+// sourceOf returns the JSON encoding of the passed in raw config, which unlike where it lives changes whenever its
+// contents do, falling back to formatting it for any config which can't be encoded
+func sourceOf(config interface{}) string {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Sprintf("%T:%v", config, config)
+	}
+	return string(encoded)
+}
+
+// get returns the value derived from the config for the passed in key by the given named parse function
+func (c *configCache) get(channel courier.Channel, key string, kind string, parse func(config interface{}) interface{}) interface{} {
+	config := channel.ConfigForKey(key, nil)
+	source := sourceOf(config)
+	cacheKey := channel.UUID().String() + "|" + kind + "|" + key
+
+	if cached, found := c.entries.Load(cacheKey); found && cached.(*cachedConfig).source == source {
+		return cached.(*cachedConfig).value
+	}
+
+	value := parse(config)
+	c.entries.Store(cacheKey, &cachedConfig{source: source, value: value})
+	return value
+}
+
+// the values derived from channel config, which must be treated as read only as they're shared between callers
+var derivedConfig = &configCache{}
+
+// stringListConfigForKey returns the list of strings configured for the passed in key, which may be saved either
+// as a JSON list or as a single comma separated string
+func stringListConfigForKey(channel courier.Channel, key string) []string {
+	return derivedConfig.get(channel, key, "list", parseStringList).([]string)
+}
+
+func parseStringList(config interface{}) interface{} {
+	var values []string
+
+	switch config := config.(type) {
+	case []string:
+		values = config
+	case []interface{}:
+		for _, v := range config {
+			if s, isString := v.(string); isString {
+				values = append(values, s)
+			}
+		}
+	case string:
+		values = strings.Split(config, ",")
+	}
+
+	cleaned := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			cleaned = append(cleaned, v)
+		}
+	}
+	return cleaned
+}
+
+// stringMapConfigForKey returns the map of strings configured for the passed in key, ignoring any non-string values
+func stringMapConfigForKey(channel courier.Channel, key string) map[string]string {
+	return derivedConfig.get(channel, key, "map", parseStringMap).(map[string]string)
+}
+
+func parseStringMap(config interface{}) interface{} {
+	values := make(map[string]string)
+
+	switch config := config.(type) {
+	case map[string]string:
+		for k, v := range config {
+			values[k] = v
+		}
+	case map[string]interface{}:
+		for k, v := range config {
+			if s, isString := v.(string); isString {
+				values[k] = s
+			}
+		}
+	}
+	return values
+}
+
+// floatConfigForKey returns the number configured for the passed in key and whether it was set at all
+func floatConfigForKey(channel courier.Channel, key string) (float64, bool) {
+	switch config := channel.ConfigForKey(key, nil).(type) {
+	case float64:
+		return config, true
+	case int:
+		return float64(config), true
+	case string:
+		value, err := strconv.ParseFloat(strings.TrimSpace(config), 64)
+		return value, err == nil
+	}
+	return 0, false
+}
+
+// floatMapConfigForKey returns the map of numbers configured for the passed in key, ignoring any values which aren't
+// numbers or numeric strings
+func floatMapConfigForKey(channel courier.Channel, key string) map[string]float64 {
+	return derivedConfig.get(channel, key, "floats", parseFloatMap).(map[string]float64)
+}
+
+func parseFloatMap(config interface{}) interface{} {
+	values := make(map[string]float64)
+
+	floats, _ := config.(map[string]interface{})
+	for k, v := range floats {
+		switch value := v.(type) {
+		case float64:
+			values[k] = value
+		case int:
+			values[k] = float64(value)
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				values[k] = f
+			}
+		}
+	}
+	return values
+}
+
+// durationMapConfigForKey returns the map of durations configured for the passed in key, where each value is either a
+// number of seconds or a duration string like "1m30s"
+func durationMapConfigForKey(channel courier.Channel, key string) map[string]time.Duration {
+	return derivedConfig.get(channel, key, "durations", parseDurationMap).(map[string]time.Duration)
+}
+
+func parseDurationMap(config interface{}) interface{} {
+	values := make(map[string]time.Duration)
+
+	durations, _ := config.(map[string]interface{})
+	for k, v := range durations {
+		switch value := v.(type) {
+		case float64:
+			values[k] = time.Duration(value * float64(time.Second))
+		case int:
+			values[k] = time.Duration(value) * time.Second
+		case string:
+			if d, err := time.ParseDuration(value); err == nil {
+				values[k] = d
+			}
+		}
+	}
+	return values
+}
+
+// compiled patterns by their source, these only depend on the pattern itself so never need invalidating
+var compiledPatterns sync.Map
+
+// compilePattern compiles the passed in case insensitive pattern, patterns which aren't valid regular expressions
+// being matched as plain keywords
+func compilePattern(pattern string) *regexp.Regexp {
+	if re, found := compiledPatterns.Load(pattern); found {
+		return re.(*regexp.Regexp)
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(pattern))
+	}
+	compiledPatterns.Store(pattern, re)
+	return re
+}
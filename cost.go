@@ -0,0 +1,38 @@
+package mista
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nyaruka/courier"
+)
+
+// the key in a channel's rate table for the rate of countries without their own
+const defaultRateKey = "*"
+
+// EstimateCost estimates what sending a message of the passed in number of segments to a recipient in the given
+// country would cost on the channel, using its rate table keyed by ISO country code like RW. Countries not in the
+// table are charged the table's default rate if it has one, otherwise the channel's cost per segment.
+func EstimateCost(channel courier.Channel, country string, segments int) (float64, error) {
+	if segments < 0 {
+		return 0, fmt.Errorf("invalid segment count %d", segments)
+	}
+
+	rate, found := segmentRate(channel, strings.ToUpper(strings.TrimSpace(country)))
+	if !found {
+		return 0, fmt.Errorf("no rate configured for country '%s'", country)
+	}
+	return rate * float64(segments), nil
+}
+
+// segmentRate returns the cost per segment of sending to the passed in country on the channel
+func segmentRate(channel courier.Channel, country string) (float64, bool) {
+	rates := floatMapConfigForKey(channel, configSegmentRates)
+	if rate, found := rates[country]; found {
+		return rate, true
+	}
+	if rate, found := rates[defaultRateKey]; found {
+		return rate, true
+	}
+	return floatConfigForKey(channel, configSegmentCost)
+}
@@ -0,0 +1,136 @@
+package mista
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/sirupsen/logrus"
+)
+
+// maximum number of inbound messages we hold on to while the backend is unavailable
+const deadLettersSize = 1000
+
+// how often we try to replay buffered messages, a var so tests can make it quicker
+var deadLetterReplayInterval = time.Minute
+
+// deadLetterBuffer holds inbound messages we acked to Mista but couldn't write, so that they can be replayed once the
+// backend is available again. Once full the oldest messages are dropped.
+type deadLetterBuffer struct {
+	mutex sync.Mutex
+	size  int
+	msgs  []courier.Msg
+}
+
+func newDeadLetterBuffer(size int) *deadLetterBuffer {
+	return &deadLetterBuffer{size: size}
+}
+
+// add adds the passed in message to the buffer, returning any older message dropped to make room for it
+func (b *deadLetterBuffer) add(msg courier.Msg) courier.Msg {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var dropped courier.Msg
+	if len(b.msgs) >= b.size {
+		dropped, b.msgs = b.msgs[0], b.msgs[1:]
+	}
+	b.msgs = append(b.msgs, msg)
+	return dropped
+}
+
+// take removes and returns all the messages in the buffer
+func (b *deadLetterBuffer) take() []courier.Msg {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	msgs := b.msgs
+	b.msgs = nil
+	return msgs
+}
+
+// startDeadLetterReplay starts replaying buffered messages in the background every interval until the server stops
+func (h *handler) startDeadLetterReplay(s courier.Server, interval time.Duration) {
+	s.WaitGroup().Add(1)
+
+	go func() {
+		defer s.WaitGroup().Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.StopChan():
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				if written, err := h.ReplayDeadLetters(ctx); err != nil {
+					logrus.WithField("written", written).WithError(err).Warn("error replaying dead letters")
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// writeMsg writes the passed in inbound message and our response to Mista, returning whether the message was actually
+// written. Normally a failed write is an error so that Mista retries it, but channels can instead have us ack the
+// message and hold on to it to be replayed later.
+func (h *handler) writeMsg(ctx context.Context, channel courier.Channel, msg courier.Msg, w http.ResponseWriter, r *http.Request) ([]courier.Event, bool, error) {
+	if !channel.BoolConfigForKey(configDeadLetter, false) {
+		events, err := handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+		return events, err == nil, err
+	}
+
+	written := true
+	if err := h.Backend().WriteMsg(ctx, msg); err != nil {
+		log := logrus.WithField("channel_uuid", channel.UUID().String()).WithField("external_id", msg.ExternalID())
+		log.WithError(err).Warn("error writing message, buffering for replay")
+
+		if dropped := h.deadLetters.add(msg); dropped != nil {
+			log.WithField("dropped_external_id", dropped.ExternalID()).Error("dead letter buffer full, dropping oldest message")
+		}
+		written = false
+	}
+	return []courier.Event{msg}, written, courier.WriteMsgSuccess(ctx, w, r, []courier.Msg{msg})
+}
+
+// msgWritten does what we do once an inbound message with an ID has been written, remembering it so retries aren't
+// duplicated and letting the sender know we got it if the channel wants that
+func (h *handler) msgWritten(msg courier.Msg) {
+	if msg.ExternalID() == "" {
+		return
+	}
+	h.Backend().WriteExternalIDSeen(msg)
+
+	// two-way flows can let the sender know we got their message
+	if msg.Channel().BoolConfigForKey(configAutoAck, false) {
+		h.ackMsg(msg.Channel(), msg.ExternalID())
+	}
+}
+
+// ReplayDeadLetters tries to write all the inbound messages buffered while the backend was unavailable, returning how
+// many were written. Any which still can't be written are kept for the next replay.
+func (h *handler) ReplayDeadLetters(ctx context.Context) (int, error) {
+	written := 0
+	var lastErr error
+
+	for _, msg := range h.deadLetters.take() {
+		// Mista may have retried a buffered message, so check whether an earlier copy has since been written
+		if msg.ExternalID() != "" {
+			msg = h.Backend().CheckExternalIDSeen(msg)
+		}
+		if err := h.Backend().WriteMsg(ctx, msg); err != nil {
+			h.deadLetters.add(msg)
+			lastErr = err
+			continue
+		}
+		h.msgWritten(msg)
+		written++
+	}
+	return written, lastErr
+}
@@ -0,0 +1,82 @@
+package mista
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// the keys sends can be deduplicated on
+const (
+	dedupKeyID            = "id"
+	dedupKeyRecipientBody = "recipient+body"
+)
+
+// default number of seconds within which a send with the same key is considered a duplicate
+const defaultDedupWindow = 10 * 60
+
+// once we've remembered this many sends we prune any which have fallen outside of their window
+const dedupPruneSize = 10000
+
+// sendDeduper remembers recent sends by their dedup key so that duplicates within a window can be skipped
+type sendDeduper struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time
+}
+
+func newSendDeduper() *sendDeduper {
+	return &sendDeduper{expires: make(map[string]time.Time)}
+}
+
+// reserve records a send with the passed in key, returning false if one with the same key was already recorded
+// within the given window
+func (d *sendDeduper) reserve(key string, window time.Duration) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	if expires, found := d.expires[key]; found && now.Before(expires) {
+		return false
+	}
+
+	if len(d.expires) >= dedupPruneSize {
+		for k, expires := range d.expires {
+			if !now.Before(expires) {
+				delete(d.expires, k)
+			}
+		}
+	}
+
+	d.expires[key] = now.Add(window)
+	return true
+}
+
+// release forgets the send with the passed in key, so that a send which didn't go through can be tried again
+func (d *sendDeduper) release(key string) {
+	if key == "" {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.expires, key)
+}
+
+// sendDedupKey returns the key that sends of the passed in message should be deduplicated on, or empty string if we
+// leave deduplication by message ID to courier itself
+func sendDedupKey(msg courier.Msg) (string, error) {
+	switch mode := msg.Channel().StringConfigForKey(configDedupKey, dedupKeyID); mode {
+	case dedupKeyID:
+		return "", nil
+	case dedupKeyRecipientBody:
+		hash := sha256.Sum256([]byte(msg.URN().Path() + "\x00" + msg.Text()))
+		return msg.Channel().UUID().String() + ":" + hex.EncodeToString(hash[:]), nil
+	default:
+		return "", fmt.Errorf("unknown dedup key '%s', must be one of '%s' or '%s'", mode, dedupKeyID, dedupKeyRecipientBody)
+	}
+}
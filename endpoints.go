@@ -0,0 +1,65 @@
+package mista
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/nyaruka/courier"
+)
+
+// the default base URL of the Mista API, channels for regional deployments and resellers can override this
+var baseURL = "https://api.mista.io"
+
+// the Mista API endpoints we make use of
+const (
+	endpointSend          = "send"
+	endpointStatus        = "status"
+	endpointBalance       = "balance"
+	endpointVerify        = "verify"
+	endpointConfirm       = "confirm"
+	endpointCancel        = "cancel"
+	endpointAck           = "ack"
+	endpointSubscriptions = "subscriptions"
+	endpointSubscription  = "subscription"
+	endpointQueue         = "queue"
+)
+
+// the channel config keys for the path template of each endpoint and the defaults if not set
+var pathTemplateConfigs = map[string]string{
+	endpointSend:          "send_path",
+	endpointStatus:        "status_path",
+	endpointBalance:       "balance_path",
+	endpointVerify:        "verify_path",
+	endpointConfirm:       "confirm_path",
+	endpointCancel:        "cancel_path",
+	endpointAck:           "ack_path",
+	endpointSubscriptions: "subscriptions_path",
+	endpointSubscription:  "subscription_path",
+	endpointQueue:         "queue_path",
+}
+
+var defaultPathTemplates = map[string]string{
+	endpointSend:          "/sms",
+	endpointStatus:        "/sms/{uid}",
+	endpointBalance:       "/balance",
+	endpointVerify:        "/verify",
+	endpointConfirm:       "/verify/{verification_id}/confirm",
+	endpointCancel:        "/sms/{uid}/cancel",
+	endpointAck:           "/sms/{uid}/ack",
+	endpointSubscriptions: "/webhooks",
+	endpointSubscription:  "/webhooks/{id}",
+	endpointQueue:         "/sms/queue",
+}
+
+// endpointURL builds the full URL of the passed in endpoint for a channel from its base URL and path template,
+// substituting any {name} placeholders in the template with the given params
+func endpointURL(channel courier.Channel, endpoint string, params map[string]string) string {
+	base := channel.StringConfigForKey(courier.ConfigBaseURL, baseURL)
+	path := channel.StringConfigForKey(pathTemplateConfigs[endpoint], defaultPathTemplates[endpoint])
+
+	for name, value := range params {
+		path = strings.ReplaceAll(path, "{"+name+"}", url.PathEscape(value))
+	}
+
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
@@ -0,0 +1,21 @@
+package mista
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/nyaruka/courier"
+)
+
+// idempotencyKeyFunc generates the idempotency key for the given part of a message sent from the given sender, which
+// must be the same every time for the same part and sender and differ between parts, senders and messages. Retrying
+// from a fallback sender is a new send, so mustn't be mistaken by Mista for a retry of the rejected one.
+type idempotencyKeyFunc func(channel courier.Channel, msgID courier.MsgID, sender string, part int) string
+
+// defaultIdempotencyKey derives the idempotency key from the channel UUID, message ID, sender and part, hashed so that
+// it's opaque and a fixed length
+func defaultIdempotencyKey(channel courier.Channel, msgID courier.MsgID, sender string, part int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%s:%d", channel.UUID(), msgID, sender, part)))
+	return hex.EncodeToString(hash[:16])
+}
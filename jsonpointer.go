@@ -0,0 +1,123 @@
+package mista
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/courier/handlers"
+)
+
+// resolvePointer resolves the passed in RFC 6901 JSON pointer against a decoded JSON document
+func resolvePointer(doc interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return doc, true
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+
+	current := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, found := node[token]
+			if !found {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// jsonPathPointer converts the passed in dotted JSON path like data.result.message_id to a JSON pointer, paths which
+// are already JSON pointers are returned as is
+func jsonPathPointer(path string) string {
+	if path == "" || strings.HasPrefix(path, "/") {
+		return path
+	}
+
+	tokens := strings.Split(path, ".")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+	}
+	return "/" + strings.Join(tokens, "/")
+}
+
+// pointerString resolves the passed in JSON pointer to a string value, returning empty string if it doesn't resolve
+// to a scalar value
+func pointerString(doc interface{}, pointer string) string {
+	value, found := resolvePointer(doc, pointer)
+	if !found {
+		return ""
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// pointerFloat resolves the passed in JSON pointer to a number, returning nil if it doesn't resolve to one
+func pointerFloat(doc interface{}, pointer string) *float64 {
+	value, found := resolvePointer(doc, pointer)
+	if !found {
+		return nil
+	}
+	number, isNumber := value.(json.Number)
+	if !isNumber {
+		return nil
+	}
+	f, err := number.Float64()
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// decodeAndValidateMapped decodes the JSON body of the passed in request into our form using the field to JSON pointer
+// mapping, then validates it
+func decodeAndValidateMapped(form *moForm, mapping map[string]string, r *http.Request) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read request body: %w", err)
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("unable to parse request JSON: %w", err)
+	}
+
+	fields := form.fields()
+	for field, pointer := range mapping {
+		target, found := fields[field]
+		if !found {
+			return fmt.Errorf("unknown field '%s' in field mapping", field)
+		}
+		*target = pointerString(doc, pointer)
+	}
+
+	return handlers.Validate(form)
+}
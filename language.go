@@ -0,0 +1,76 @@
+package mista
+
+import (
+	"strings"
+	"unicode"
+)
+
+// common words of the languages we can detect, keyed by their ISO 639-3 code
+var languageStopwords = map[string][]string{
+	"eng": {"the", "and", "is", "are", "you", "to", "of", "my", "what", "how", "please", "thanks", "yes", "no", "have", "with", "for", "this", "that", "hello"},
+	"fra": {"le", "la", "les", "et", "est", "vous", "je", "de", "des", "une", "mon", "merci", "oui", "non", "avec", "pour", "bonjour", "pas", "que", "qui"},
+	"kin": {"ni", "na", "muri", "kandi", "ndashaka", "murakoze", "yego", "oya", "mwaramutse", "amakuru", "nti", "ubu", "cyane", "kuri", "iki", "uko", "bite", "ese", "nde", "ryari"},
+	"swa": {"na", "ni", "wa", "kwa", "habari", "asante", "ndiyo", "hapana", "mimi", "wewe", "sana", "nini", "hii", "kama", "lakini", "tafadhali", "jambo", "karibu", "leo", "kesho"},
+}
+
+// languages written in their own scripts which can be detected without looking at words
+var languageScripts = []struct {
+	language string
+	script   *unicode.RangeTable
+}{
+	{"ara", unicode.Arabic},
+	{"amh", unicode.Ethiopic},
+	{"rus", unicode.Cyrillic},
+	{"zho", unicode.Han},
+}
+
+// detectLanguage makes a best guess at the language of the passed in text, returning its ISO 639-3 code or empty
+// string if it isn't clearly any one language
+func detectLanguage(text string) string {
+	letters := 0
+	scripts := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, s := range languageScripts {
+			if unicode.Is(s.script, r) {
+				scripts[s.language]++
+				break
+			}
+		}
+	}
+
+	// anything mostly written in a distinctive script is in that script's language
+	for language, count := range scripts {
+		if count*2 > letters {
+			return language
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' })
+	best, bestScore, tied := "", 0, false
+	for language, stopwords := range languageStopwords {
+		score := 0
+		for _, word := range words {
+			for _, stopword := range stopwords {
+				if word == stopword {
+					score++
+					break
+				}
+			}
+		}
+
+		if score > bestScore {
+			best, bestScore, tied = language, score, false
+		} else if score == bestScore && score > 0 {
+			tied = true
+		}
+	}
+
+	if tied {
+		return ""
+	}
+	return best
+}
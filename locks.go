@@ -0,0 +1,45 @@
+package mista
+
+import (
+	"sync"
+)
+
+// keyedMutex provides mutual exclusion between callers using the same key, with locks only held in memory while in use
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*refCountedMutex
+}
+
+type refCountedMutex struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*refCountedMutex)}
+}
+
+// lock blocks until the lock for the passed in key is held, returning a function which releases it
+func (k *keyedMutex) lock(key string) func() {
+	k.mutex.Lock()
+	l, found := k.locks[key]
+	if !found {
+		l = &refCountedMutex{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mutex.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		k.mutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
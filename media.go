@@ -0,0 +1,98 @@
+package mista
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// how long we wait for a media host to tell us about a single item of media
+const mediaRequestTimeout = 10 * time.Second
+
+// how long we spend inspecting all the media of a single message
+const mediaInspectTimeout = 20 * time.Second
+
+// mediaClientForChannel returns the client used to inspect inbound media for the passed in channel, which has the
+// same transport settings as its send client but limits how long each request can take. As anyone who can send the
+// channel a message can choose these URLs, it can only connect to public addresses.
+func (h *handler) mediaClientForChannel(channel courier.Channel) (httpClient, error) {
+	config, err := transportConfigForChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+	config.timeout = mediaRequestTimeout
+	config.publicOnly = true
+	return h.clientForConfig(channel, config), nil
+}
+
+// parseMediaURLs splits the comma separated list of media URLs delivered with an inbound message
+func parseMediaURLs(media string) []string {
+	urls := make([]string, 0)
+	for _, u := range strings.Split(media, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// typedAttachment returns the passed in media URL as an attachment prefixed with its content type, or as is if we
+// don't know what type it is
+func typedAttachment(mediaURL string, contentType string) string {
+	if contentType == "" {
+		return mediaURL
+	}
+	return contentType + ":" + mediaURL
+}
+
+// contentTypeFromExtension returns the content type implied by the extension of the passed in media URL
+func contentTypeFromExtension(mediaURL string) string {
+	parsed, err := url.Parse(mediaURL)
+	if err != nil {
+		return ""
+	}
+	return baseContentType(mime.TypeByExtension(strings.ToLower(path.Ext(parsed.Path))))
+}
+
+// mediaInfo is what a media host told us about an item of media, with a size of -1 if it didn't tell us that
+type mediaInfo struct {
+	contentType string
+	size        int64
+}
+
+// inspectMedia makes a HEAD request for the passed in media URL to find its content type and size
+func inspectMedia(ctx context.Context, client httpClient, mediaURL string) *mediaInfo {
+	info := &mediaInfo{size: -1}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, mediaURL, nil)
+	if err != nil {
+		return info
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return info
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return info
+	}
+	info.contentType = baseContentType(resp.Header.Get("Content-Type"))
+	info.size = resp.ContentLength
+	return info
+}
+
+// baseContentType strips any parameters from the passed in content type
+func baseContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
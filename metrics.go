@@ -0,0 +1,115 @@
+package mista
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/librato"
+)
+
+// how often we report the number of send events
+var metricsInterval = time.Minute
+
+// sendMetrics tracks our sends to Mista for each channel, reporting how many are queued and in flight as librato
+// gauges whenever they change, and how many attempts and failures there have been as a total for each interval.
+type sendMetrics struct {
+	// reports a metric, can be replaced to record them
+	gauge func(name string, value float64)
+
+	mutex  sync.Mutex
+	levels map[string]int64
+	counts map[string]int64
+}
+
+func newSendMetrics() *sendMetrics {
+	return &sendMetrics{gauge: librato.Gauge, levels: make(map[string]int64), counts: make(map[string]int64)}
+}
+
+// start reports our counts every interval until the server stops, and once more as it does
+func (m *sendMetrics) start(s courier.Server, interval time.Duration) {
+	s.WaitGroup().Add(1)
+
+	go func() {
+		defer s.WaitGroup().Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.StopChan():
+				m.flush()
+				return
+			case <-ticker.C:
+				m.flush()
+			}
+		}
+	}()
+}
+
+// sendQueued records a send on the passed in channel waiting for a send slot, returning a func to call once it has one
+func (m *sendMetrics) sendQueued(channel courier.Channel) func() {
+	m.adjust("queued", channel, 1)
+	return func() { m.adjust("queued", channel, -1) }
+}
+
+// sendStarted records a send on the passed in channel being in flight, returning a func to call once it's complete
+func (m *sendMetrics) sendStarted(channel courier.Channel) func() {
+	m.adjust("in_flight", channel, 1)
+	return func() { m.adjust("in_flight", channel, -1) }
+}
+
+// sendAttempted records a request being made to Mista on the passed in channel
+func (m *sendMetrics) sendAttempted(channel courier.Channel) {
+	m.increment("attempt", channel)
+}
+
+// sendFailed records a send on the passed in channel failing in the given phase
+func (m *sendMetrics) sendFailed(channel courier.Channel, phase string) {
+	m.increment("error_"+phase, channel)
+}
+
+// increment counts a single occurrence of the passed in event, which is reported with the rest of the interval's
+// occurrences as librato averages the values of a gauge reported more than once in a period rather than adding them
+func (m *sendMetrics) increment(name string, channel courier.Channel) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.counts[metricName(name, channel)]++
+}
+
+// flush reports how many times each event has occurred since the last flush
+func (m *sendMetrics) flush() {
+	m.mutex.Lock()
+	counts := m.counts
+	m.counts = make(map[string]int64)
+	m.mutex.Unlock()
+
+	for name, count := range counts {
+		m.gauge(name, float64(count))
+	}
+}
+
+// adjust changes the level of the passed in gauge by delta and reports its new level, forgetting levels back at zero
+func (m *sendMetrics) adjust(name string, channel courier.Channel, delta int64) {
+	gauge := metricName(name, channel)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	level := m.levels[gauge] + delta
+	if level == 0 {
+		delete(m.levels, gauge)
+	} else {
+		m.levels[gauge] = level
+	}
+	m.gauge(gauge, float64(level))
+}
+
+// metricName returns the name of the passed in send metric for the given channel, like
+// courier.msg_send_attempt_3a2b1c4d-...
+func metricName(name string, channel courier.Channel) string {
+	return fmt.Sprintf("courier.msg_send_%s_%s", name, channel.UUID())
+}
@@ -1,21 +1,205 @@
 package mista
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"errors"
-
 
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/gocommon/gsm7"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/phonenumbers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	configTransliterate          = "transliterate"
+	configBlocklist              = "blocklist"
+	configSendURLs               = "send_urls"
+	configInsecure               = "insecure"
+	configValidateReference      = "validate_reference"
+	configErrorCodes             = "error_codes"
+	configMaxRetries             = "max_retries"
+	configIdempotencyKey         = "idempotency_key"
+	configMaxSegments            = "max_segments"
+	configSegmentPolicy          = "segment_policy"
+	configFieldMapping           = "field_mapping"
+	configSendEncoding           = "send_encoding"
+	configReferenceFields        = "reference_fields"
+	configNewlineMode            = "newline_mode"
+	configRetryExpired           = "retry_expired"
+	configSystemMessages         = "system_messages"
+	configProhibitedPatterns     = "prohibited_patterns"
+	configIdleConnTimeout        = "idle_conn_timeout"
+	configMaxConnLifetime        = "max_conn_lifetime"
+	configTrimWhitespace         = "trim_whitespace"
+	configCollapseWhitespace     = "collapse_whitespace"
+	configLowBalanceThreshold    = "low_balance_threshold"
+	configSplitMessages          = "split_messages"
+	configMaxParts               = "max_parts"
+	configTag                    = "tag"
+	configLabel                  = "label"
+	configSuppressBlocked        = "suppress_blocked"
+	configSuppressionTTL         = "suppression_ttl"
+	configPriorityKeywords       = "priority_keywords"
+	configSendTimeout            = "send_timeout"
+	configPriorityTimeouts       = "priority_timeouts"
+	configRelayURL               = "relay_url"
+	configAPIVersion             = "api_version"
+	configPrefixRoutes           = "prefix_routes"
+	configAcceptEmptyFrom        = "accept_empty_from"
+	configSystemSender           = "system_sender"
+	configURNScheme              = "urn_scheme"
+	configAckHeaders             = "ack_headers"
+	configSubstitutePlaceholders = "substitute_placeholders"
+	configUnmatchedPlaceholders  = "unmatched_placeholders"
+	configSendRate               = "send_rate"
+	configSendBurst              = "send_burst"
+	configAggregateParts         = "aggregate_parts"
+	configSegmentCost            = "segment_cost"
+	configMMSFallbackText        = "mms_fallback_text"
+	configUnencodablePolicy      = "unencodable_policy"
+	configTLSMinVersion          = "tls_min_version"
+	configDetectLanguage         = "detect_language"
+	configLogSampleRate          = "log_sample_rate"
+	configDedupKey               = "dedup_key"
+	configDedupWindow            = "dedup_window"
+	configFallbackSender         = "fallback_sender"
+	configAcceptAsSent           = "accept_as_sent"
+	configMaxAttachments         = "max_attachments"
+	configAttachmentLimitPolicy  = "attachment_limit_policy"
+	configLogInvalidSenders      = "log_invalid_senders"
+	configResponseUIDPath        = "response_uid_path"
+	configResponseStatusPath     = "response_status_path"
+	configCompressRequests       = "compress_requests"
+	configCompressMinSize        = "compress_min_size"
+	configAutoAck                = "auto_ack"
+	configAckStatus              = "ack_status"
+	configDeadLetter             = "dead_letter"
+	configSplitStrategy          = "split_strategy"
+	configManageSubscriptions    = "manage_subscriptions"
+	configRetryStatusCodes       = "retry_status_codes"
+	configPartConcurrency        = "part_concurrency"
+	configPseudonymKey           = "pseudonym_key"
+	configNormalizeUIDs          = "normalize_uids"
+	configUIDPrefix              = "uid_prefix"
+	configSoftBounceCodes        = "soft_bounce_codes"
+	configFailSoftBounces        = "fail_soft_bounces"
+	configBufferedStatus         = "buffered_status"
+	configRequestDLR             = "request_dlr"
+	configReceiveRate            = "receive_rate"
+	configReceiveBurst           = "receive_burst"
+	configEchoStatusAcks         = "echo_status_acks"
+	configStatusDedupWindow      = "status_dedup_window"
+	configBlockLandlines         = "block_landlines"
+	configEncodingOrder          = "encoding_order"
+	configSplitAttachments       = "split_attachments"
+	configTLSCipherSuites        = "tls_cipher_suites"
+	configMaxAttachmentSize      = "max_attachment_size"
+	configPartChunkSize          = "part_chunk_size"
+	configMaxBatchSize           = "max_batch_size"
+	configSegmentRates           = "segment_rates"
+)
+
+// what to do with messages which would be sent as more than the maximum number of segments
+const (
+	segmentPolicyReject   = "reject"
+	segmentPolicyTruncate = "truncate"
+	segmentPolicySend     = "send"
+)
+
+// message priorities
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+)
+
+// how long messages are split into parts, either avoiding breaking words across parts where possible or at exactly
+// the maximum length
+const (
+	splitStrategyWord = "word"
+	splitStrategyHard = "hard"
+)
+
+// what buffered statuses are treated as, either sent or still only wired to Mista
+const (
+	bufferedStatusSent  = "sent"
+	bufferedStatusWired = "wired"
+)
+
+// the encodings messages can be sent with, cheaper GSM7 or UCS-2 which can represent more characters
+const (
+	encodingGSM  = "gsm"
+	encodingUCS2 = "ucs2"
 )
 
-var sendURL = "https://api.mista.io/sms"
+// the order we try encodings in by default, preferring the cheaper one
+var defaultEncodingOrder = []string{encodingGSM, encodingUCS2}
+
+// how the parts of long messages are sent, either one after another so that they arrive in order or in chunks at once
+const (
+	partConcurrencySequential = "sequential"
+	partConcurrencyConcurrent = "concurrent"
+)
+
+// what to do with inbound messages with more than the maximum number of attachments
+const (
+	attachmentLimitPolicyDrop   = "drop"
+	attachmentLimitPolicyReject = "reject"
+)
+
+// what to do with messages containing characters which can't be encoded
+const (
+	unencodablePolicyWarn = "warn"
+	unencodablePolicyFail = "fail"
+)
+
+// statuses from version 2 of Mista's API nest their delivery details in a report
+const apiVersionV2 = "v2"
+
+// how newlines in outgoing messages are sent
+const (
+	newlineModeRaw   = "raw"
+	newlineModeCRLF  = "crlf"
+	newlineModeStrip = "strip"
+)
+
+// whether to register our debug routes, which must never be enabled in production
+var debugRoutes = os.Getenv("COURIER_MISTA_DEBUG_ROUTES") == "true"
+
+// defaults for the maximum number of segments Mista will send a message as, and when auto-splitting, the maximum number
+// of parts we'll split a message into. Unless the channel says otherwise, each part is a single segment long.
+const (
+	defaultMaxSegments = 10
+	defaultMaxParts    = 5
+)
+
+// default number of parts we send at once when sending them concurrently
+const defaultPartChunkSize = 10
+
+// the external identifier of the contact messages without a sender are received from
+const defaultSystemSender = "mista-system"
+
+// default size in bytes of the smallest send request body we compress
+const defaultCompressMinSize = 1024
+
+// the status we acknowledge inbound messages with by default
+const defaultAckStatus = "received"
+
+// default number of seconds we give each send request
+const defaultSendTimeout = 30
+
+// default size in bytes of the largest inbound attachment we accept, 0 meaning no limit
+const defaultMaxAttachmentSize = 10 * 1024 * 1024
 
 func init() {
 	courier.RegisterHandler(newHandler())
@@ -23,37 +207,249 @@ func init() {
 
 type handler struct {
 	handlers.BaseHandler
+
+	scheduler         *fairScheduler
+	receiveLocks      *keyedMutex
+	metrics           *sendMetrics
+	moderators        []contentModerator
+	urnBuilders       map[string]urnBuilder
+	clients           sync.Map
+	lowBalances       sync.Map
+	balanceWatches    sync.Map
+	suppressed        sync.Map
+	throttles         sync.Map
+	invalidTransports sync.Map
+	reconciled        sync.Map
+	recentUIDs        *uidCache
+	parts             *partTracker
+	logSampler        *logSampler
+	deduper           *sendDeduper
+	statusDedup       *sendDeduper
+	deadLetters       *deadLetterBuffer
+	sendTimes         *sendTimes
+
+	// generates the idempotency keys of send requests, can be replaced to make keys predictable
+	idempotencyKey idempotencyKeyFunc
+
+	// creates the HTTP clients we make requests with, can be replaced to stub out Mista
+	newClient clientFactory
 }
 
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("MX"), "Mista")}
+	return &handler{
+		BaseHandler:  handlers.NewBaseHandler(courier.ChannelType("MX"), "Mista"),
+		scheduler:    newFairScheduler(maxConcurrentSends),
+		receiveLocks: newKeyedMutex(),
+		metrics:      newSendMetrics(),
+		moderators:   []contentModerator{patternModerator},
+		urnBuilders:  defaultURNBuilders,
+		recentUIDs:   newUIDCache(recentUIDsSize),
+		parts:        newPartTracker(trackedPartsSize),
+		logSampler:   newLogSampler(),
+		deduper:      newSendDeduper(),
+		statusDedup:  newSendDeduper(),
+		deadLetters:  newDeadLetterBuffer(deadLettersSize),
+		sendTimes:    newSendTimes(sendTimesSize),
+
+		idempotencyKey: defaultIdempotencyKey,
+		newClient:      defaultClientFactory,
+	}
 }
 
 type moForm struct {
-	ID   string `name:"id"`
-	Body string `validate:"required" name:"body"`
-	From string `validate:"required" name:"from"`
-	To   string `validate:"required" name:"to"`
-	Date string `name:"date"`
+	ID        string `name:"id"`
+	Body      string `validate:"required" name:"body"`
+	From      string `name:"from"`
+	To        string `validate:"required" name:"to"`
+	Date      string `name:"date"`
+	Direction string `name:"direction"`
+	SMSType   string `name:"sms_type"`
+	Encoding  string `name:"encoding"`
+	Coding    string `name:"coding"`
+	Charset   string `name:"charset"`
+	SessionID string `name:"session_id"`
+	Media     string `name:"media"`
+	MediaType string `name:"media_type"`
+	Language  string `name:"language"`
+	Urgent    string `name:"urgent"`
+	Priority  string `name:"priority"`
+	Source    string `name:"source"`
+}
+
+// fields returns the fields of our form by name, as used in field mappings
+func (f *moForm) fields() map[string]*string {
+	return map[string]*string{
+		"id":         &f.ID,
+		"body":       &f.Body,
+		"from":       &f.From,
+		"to":         &f.To,
+		"date":       &f.Date,
+		"direction":  &f.Direction,
+		"sms_type":   &f.SMSType,
+		"encoding":   &f.Encoding,
+		"coding":     &f.Coding,
+		"charset":    &f.Charset,
+		"session_id": &f.SessionID,
+		"source":     &f.Source,
+		"media":      &f.Media,
+		"media_type": &f.MediaType,
+		"language":   &f.Language,
+		"urgent":     &f.Urgent,
+		"priority":   &f.Priority,
+	}
+}
+
+// values of direction or sms_type which mark a record as one of our own outbound messages echoed back to us
+var outboundDirections = map[string]bool{
+	"outbound": true,
+	"outgoing": true,
+	"out":      true,
+	"mt":       true,
+}
+
+// isOutboundEcho returns whether the passed in form is an echo of an outbound message rather than a true inbound
+func isOutboundEcho(form *moForm) bool {
+	for _, value := range []string{form.Direction, form.SMSType} {
+		if outboundDirections[strings.ToLower(strings.TrimSpace(value))] {
+			return true
+		}
+	}
+	return false
+}
+
+// isUrgent returns whether Mista flagged the passed in inbound message as urgent, either with its urgent flag or by
+// giving it a high priority
+func isUrgent(form *moForm) bool {
+	if urgent, err := strconv.ParseBool(strings.TrimSpace(form.Urgent)); err == nil && urgent {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(form.Priority)) {
+	case priorityHigh, "urgent":
+		return true
+	}
+	return false
+}
+
+// matchesBlocklist returns whether the passed in text matches any of the patterns in the channel's blocklist
+func matchesBlocklist(channel courier.Channel, text string) bool {
+	return matchesAnyPattern(stringListConfigForKey(channel, configBlocklist), text)
+}
+
+// containsKeyword returns whether the passed in text contains any of the given keywords as whole words. Go's \b only
+// knows ASCII word characters, so we find word boundaries ourselves to match keywords in any script.
+func containsKeyword(keywords []string, text string) bool {
+	for _, keyword := range keywords {
+		if compilePattern(`(?:^|[^\p{L}\p{M}\p{N}_])` + regexp.QuoteMeta(keyword) + `(?:[^\p{L}\p{M}\p{N}_]|$)`).MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyPattern returns whether the passed in text matches any of the given case insensitive patterns, patterns
+// which aren't valid regular expressions are matched as plain keywords
+func matchesAnyPattern(patterns []string, text string) bool {
+	for _, pattern := range patterns {
+		if compilePattern(pattern).MatchString(text) {
+			return true
+		}
+	}
+	return false
 }
 
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
-	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveMessage)
-	s.AddHandlerRoute(h, http.MethodPost, "status", h.receiveStatus)
+	s.AddHandlerRoute(h, http.MethodPost, "receive", h.withTransportCheck(h.withSubscriptions(h.receiveMessage)))
+	s.AddHandlerRoute(h, http.MethodPost, "status", h.withTransportCheck(h.withSubscriptions(h.receiveStatus)))
+	s.AddHandlerRoute(h, http.MethodPost, "ussd", h.withTransportCheck(h.withSubscriptions(h.receiveUSSD)))
+
+	// lets a DLR be injected for any external ID and status to test delivery dependent flows without a carrier
+	if debugRoutes {
+		s.AddHandlerRoute(h, http.MethodPost, "simulate_dlr", h.receiveStatus)
+	}
+
+	// messages buffered while the backend was unavailable are replayed until we're stopped
+	h.startDeadLetterReplay(s, deadLetterReplayInterval)
+
+	// and the number of send events reported every interval
+	h.metrics.start(s, metricsInterval)
 	return nil
 }
 
+// writeAckHeaders adds any headers the channel is configured to include in the responses that acknowledge Mista's
+// webhook requests
+func writeAckHeaders(channel courier.Channel, w http.ResponseWriter) {
+	for name, value := range stringMapConfigForKey(channel, configAckHeaders) {
+		w.Header().Set(name, value)
+	}
+}
+
+// logInvalidSender writes a channel log recording the raw sender of an inbound message we couldn't create a URN for
+func (h *handler) logInvalidSender(ctx context.Context, channel courier.Channel, r *http.Request, sender string, err error) {
+	log := courier.NewChannelLog("Invalid Sender", channel, courier.NilMsgID, r.Method, r.URL.String(), http.StatusBadRequest, "", "", 0, fmt.Errorf("unable to create URN for sender '%s': %w", sender, err))
+	if err := h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log}); err != nil {
+		logrus.WithField("channel_uuid", channel.UUID().String()).WithError(err).Error("error writing invalid sender log")
+	}
+}
+
 // receiveMessage is our HTTP handler function for incoming messages
 func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
-	// get our params
+	writeAckHeaders(channel, w)
+
+	// protect our flows from floods of incoming messages by having Mista try again later
+	if allowed, retryAfter := h.allowReceive(channel); !allowed {
+		return nil, h.writeThrottled(ctx, channel, w, r, retryAfter)
+	}
+
+	// get our params, either from a regular form or mapped from a custom JSON structure
 	form := &moForm{}
-	err := handlers.DecodeAndValidateForm(form, r)
+	var err error
+	if mapping := stringMapConfigForKey(channel, configFieldMapping); len(mapping) > 0 {
+		err = decodeAndValidateMapped(form, mapping, r)
+	} else {
+		err = handlers.DecodeAndValidateForm(form, r)
+	}
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	// Mista delivers echoes of our outbound messages to the same webhook, ack those without creating a message
+	if isOutboundEcho(form) {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "ignoring outbound message echo")
+	}
+
+	// convert our body to UTF-8 if it was delivered in another encoding, which depending on the account can be given
+	// in any of these fields
+	form.Body, err = decodeBody(form.Body, firstNonEmpty(form.Encoding, form.Coding, form.Charset))
 	if err != nil {
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 	}
 
+	// normalize any whitespace padding or injected by the network so keywords match
+	if channel.BoolConfigForKey(configCollapseWhitespace, false) {
+		form.Body = strings.Join(strings.Fields(form.Body), " ")
+	} else if channel.BoolConfigForKey(configTrimWhitespace, true) {
+		form.Body = strings.TrimSpace(form.Body)
+	}
+
+	// Mista delivers some system messages without a sender, ack those we've been configured to expect and, unless
+	// we've been configured to accept them from a system URN, error on others
+	acceptEmptyFrom := channel.BoolConfigForKey(configAcceptEmptyFrom, false)
+	if form.From == "" {
+		if matchesAnyPattern(stringListConfigForKey(channel, configSystemMessages), form.Body) {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "ignoring system message without sender")
+		}
+		if !acceptEmptyFrom {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, errors.New("field 'from' required"))
+		}
+	}
+
+	// drop anything matching our blocklist before it reaches any flows
+	if matchesBlocklist(channel, form.Body) {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "ignoring message matching blocklist")
+	}
+
 	fmt.Printf("Received date: %s\n", form.Date) // Print the received date for debugging purposes
 
 	// Parse the date string
@@ -71,134 +467,784 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 	}
 
 	// create our URN
-	urn, err := handlers.StrictTelForCountry(form.From, channel.Country())
+	var urn urns.URN
+	if form.From == "" {
+		urn, err = urns.NewURNFromParts(urns.ExternalScheme, channel.StringConfigForKey(configSystemSender, defaultSystemSender), "", "")
+	} else {
+		urn, err = h.senderURN(channel, form.Source, form.From)
+	}
 	if err != nil {
+		// recurring bad sender formats are hard to diagnose from rejected requests alone, so record what we were sent
+		// unless the channel can't store numbers
+		if channel.BoolConfigForKey(configLogInvalidSenders, false) && channel.StringConfigForKey(configPseudonymKey, "") == "" {
+			h.logInvalidSender(ctx, channel, r, form.From, err)
+		}
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 	}
 
+	// deployments which can't store phone numbers store senders as pseudonyms we can reverse to reply to them
+	country := originCountry(urn)
+	if form.From != "" {
+		urn, err = pseudonymize(channel, urn)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+	}
+
 	// build our msg
 	msg := h.Backend().NewIncomingMsg(channel, urn, form.Body).WithExternalID(form.ID).WithReceivedOn(date)
 
-	// and finally write our message
-	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
-}
+	// add any media, making sure we know what type it is, an explicit type can only apply when there's a single item
+	mediaURLs := parseMediaURLs(form.Media)
+	mediaType := ""
+	if len(mediaURLs) == 1 {
+		mediaType = form.MediaType
+	}
+
+	// don't let abusive messages with lots of media through, either dropping the extras or the whole message
+	if maxAttachments := channel.IntConfigForKey(configMaxAttachments, 0); maxAttachments > 0 && len(mediaURLs) > maxAttachments {
+		if channel.StringConfigForKey(configAttachmentLimitPolicy, attachmentLimitPolicyDrop) == attachmentLimitPolicyReject {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("message has %d attachments, more than the maximum of %d", len(mediaURLs), maxAttachments))
+		}
+
+		logrus.WithField("channel_uuid", channel.UUID().String()).WithField("external_id", form.ID).WithField("dropped", mediaURLs[maxAttachments:]).Warn("dropping attachments over limit")
+		mediaURLs = mediaURLs[:maxAttachments]
+	}
+
+	// we inspect media with the channel's own transport settings, but if they're invalid that's a problem with its
+	// sends, so rather than turn away its messages we accept their media without inspecting it
+	var mediaClient httpClient
+	if len(mediaURLs) > 0 {
+		if mediaClient, err = h.mediaClientForChannel(channel); err != nil {
+			logrus.WithField("channel_uuid", channel.UUID().String()).WithField("external_id", form.ID).WithError(err).Error("invalid transport settings, accepting media without inspecting it")
+		}
+	}
+
+	// if Mista didn't give us the type of media we derive it from its extension, falling back to asking its host, and
+	// when there's a size limit we also need to ask its host how big it is, but only ever with a single request
+	maxSize := int64(channel.IntConfigForKey(configMaxAttachmentSize, defaultMaxAttachmentSize))
+	inspectCtx, cancel := context.WithTimeout(ctx, mediaInspectTimeout)
+	defer cancel()
+
+	for _, mediaURL := range mediaURLs {
+		contentType := mediaType
+		if contentType == "" {
+			contentType = contentTypeFromExtension(mediaURL)
+		}
+
+		info := &mediaInfo{size: -1}
+		if mediaClient != nil && (contentType == "" || maxSize > 0) {
+			info = inspectMedia(inspectCtx, mediaClient, mediaURL)
+		}
+
+		// oversized media could exhaust our storage, so skip any that's too big while still delivering the text, but as
+		// plenty of hosts don't tell us how big media is we can't skip media just because we don't know
+		if maxSize > 0 && info.size > maxSize {
+			logrus.WithField("channel_uuid", channel.UUID().String()).WithField("external_id", form.ID).WithField("media_url", mediaURL).WithField("size", info.size).Warn("skipping attachment over size limit")
+			continue
+		}
+		if maxSize > 0 && info.size < 0 {
+			logrus.WithField("channel_uuid", channel.UUID().String()).WithField("external_id", form.ID).WithField("media_url", mediaURL).Info("accepting attachment of unknown size")
+		}
+		if contentType == "" {
+			contentType = info.contentType
+		}
+		msg = msg.WithAttachment(typedAttachment(mediaURL, contentType))
+	}
+
+	// keep track of the conversation this belongs to so that replies stay in the same thread
+	metadata := map[string]interface{}{}
+	if form.SessionID != "" {
+		metadata["session_id"] = form.SessionID
+	}
 
-type statusForm struct {
-	ID     string `validate:"required" name:"id"`
-	Status string `validate:"required" name:"status"`
+	// record where the sender is from for routing and analytics
+	if country != "" {
+		metadata["origin_country"] = country
+	}
+
+	// record the language of the message so it can be routed to a flow in that language, preferring Mista's own
+	if channel.BoolConfigForKey(configDetectLanguage, false) {
+		if language := firstNonEmpty(strings.TrimSpace(form.Language), detectLanguage(form.Body)); language != "" {
+			metadata["language"] = language
+		}
+	}
+
+	// flag anything Mista marked as urgent or containing a high priority keyword so flows can handle it faster
+	if isUrgent(form) {
+		metadata["urgent"] = true
+		metadata["priority"] = priorityHigh
+	} else if containsKeyword(stringListConfigForKey(channel, configPriorityKeywords), form.Body) {
+		metadata["priority"] = priorityHigh
+	}
+
+	if len(metadata) > 0 {
+		encoded, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, err
+		}
+		msg = msg.WithMetadata(encoded)
+	}
+
+	// without an ID we have no way of recognizing retries
+	if form.ID == "" {
+		events, _, err := h.writeMsg(ctx, channel, msg, w, r)
+		return events, err
+	}
+
+	// Mista retries callbacks which are slow to be acked, so a retry can arrive while the original is still being
+	// written. Wait for any in progress write of the same ID so we can recognize it as seen rather than duplicate it.
+	unlock := h.receiveLocks.lock(channel.UUID().String() + ":" + form.ID)
+	defer unlock()
+
+	msg = h.Backend().CheckExternalIDSeen(msg)
+
+	// and finally write our message, only remembering it as seen once it's actually been written
+	events, written, err := h.writeMsg(ctx, channel, msg, w, r)
+	if written {
+		h.msgWritten(msg)
+	}
+	return events, err
 }
 
-var statusMapping = map[string]courier.MsgStatusValue{
-	"Success":  courier.MsgDelivered,
-	"Sent":     courier.MsgSent,
-	"Buffered": courier.MsgSent,
-	"Rejected": courier.MsgFailed,
-	"Failed":   courier.MsgFailed,
-	"Expired":  courier.MsgFailed,
+// mtPayload is the payload of a send request to Mista
+type mtPayload struct {
+	Recipient string                 `json:"recipient"`
+	SenderID  string                 `json:"sender_id"`
+	Message   string                 `json:"message"`
+	Type      string                 `json:"type"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Reference string                 `json:"reference"`
+	ClientRef string                 `json:"client_ref,omitempty"`
+	Custom    string                 `json:"custom,omitempty"`
+	Tag       string                 `json:"tag,omitempty"`
+	Label     string                 `json:"label,omitempty"`
+	SessionID string                 `json:"session_id,omitempty"`
+	Media     []string               `json:"media,omitempty"`
+	Fallback  string                 `json:"fallback_text,omitempty"`
+	DLR       bool                   `json:"dlr"`
 }
 
-// receiveStatus is our HTTP handler function for status updates
-func (h *handler) receiveStatus(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
-	// get our params
-	form := &statusForm{}
-	err := handlers.DecodeAndValidateForm(form, r)
+// SendMsg sends the passed-in message, returning any error
+func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+	h.reconcileOnce(msg.Channel())
+	h.watchBalance(msg.Channel())
+	h.checkTransportConfig(ctx, msg.Channel())
+
+	dedupKey, err := sendDedupKey(msg)
 	if err != nil {
-		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+	if dedupKey == "" {
+		return h.sendMsg(ctx, msg)
 	}
 
-	msgStatus, found := statusMapping[form.Status]
-	if !found {
-		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r,
-			fmt.Errorf("unknown status '%s', must be one of 'Success','Sent','Buffered','Rejected', 'Failed', or 'Expired'", form.Status))
+	// skip anything we've already sent within the window, only remembering sends which actually went through
+	window := time.Duration(msg.Channel().IntConfigForKey(configDedupWindow, defaultDedupWindow)) * time.Second
+	if !h.deduper.reserve(dedupKey, window) {
+		return h.failedStatus(msg, "Duplicate Message", errors.New("same message already sent to this recipient")), nil
 	}
 
-	// write our status
-	status := h.Backend().NewMsgStatusForExternalID(channel, form.ID, msgStatus)
-	return handlers.WriteMsgStatusAndResponse(ctx, h, channel, status, w, r)
+	status, err := h.sendMsg(ctx, msg)
+	if err != nil || status.Status() != acceptedStatus(msg.Channel()) {
+		h.deduper.release(dedupKey)
+	}
+	return status, err
 }
 
-// SendMsg sends the passed-in message, returning any error
-func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+// sendMsg sends the passed-in message to Mista
+func (h *handler) sendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	apiKey := "Bearer " + msg.Channel().StringConfigForKey(courier.ConfigAPIKey, "")
 	if apiKey == "" {
 		return nil, fmt.Errorf("no API key set for Mista channel")
 	}
 
-	type RequestParams struct {
-		Recipient string `json:"recipient"`
-		SenderID  string `json:"sender_id"`
-		Message   string `json:"message"`
-		Type      string `json:"type"`
+	// contacts may be known to us only by a pseudonym, in which case we reverse it to get who to send to
+	recipient, err := recipientForURN(msg.Channel(), msg.URN())
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	// don't waste credits on recipients who recently turned out to be blocked
+	suppressBlocked := msg.Channel().BoolConfigForKey(configSuppressBlocked, false)
+	if suppressBlocked && h.isSuppressed(msg.Channel(), recipient) {
+		return h.failedStatus(msg, "Recipient Suppressed", errors.New("recipient is blocked, sends to it are suppressed")), nil
+	}
+
+	// most carriers can't deliver SMS to landlines so don't waste attempts on them
+	if msg.Channel().BoolConfigForKey(configBlockLandlines, false) && msg.URN().Scheme() == urns.TelScheme && isLandline(recipient) {
+		return h.failedStatus(msg, "Landline Recipient", errors.New("recipient is a landline number which can't receive SMS")), nil
+	}
+
+	metadata, err := parseMsgMetadata(msg)
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	// if we're relaying then the relay takes care of encoding and authenticating our message for Mista, but
+	// prohibited content must never reach Mista by any route
+	if relayURL := msg.Channel().StringConfigForKey(configRelayURL, ""); relayURL != "" {
+		if err := h.moderate(msg.Channel(), msg.Text()); err != nil {
+			return h.failedStatus(msg, "Message Moderated", err), nil
+		}
+		return h.relayMsg(ctx, msg, metadata, recipient, relayURL)
+	}
+
+	// personalize our message with any contact attributes the flow gave us
+	text := msg.Text()
+	if msg.Channel().BoolConfigForKey(configSubstitutePlaceholders, false) {
+		text, err = substitutePlaceholders(text, metadata.Attributes, msg.Channel().StringConfigForKey(configUnmatchedPlaceholders, unmatchedPlaceholdersLeave))
+		if err != nil {
+			return nil, h.sendFailure(msg, sendPhaseBuild, err)
+		}
+	}
+
+	text, msgType, err := encodeText(msg.Channel(), text)
+
+	// a message the channel can't encode will never be sendable, so retrying it won't help
+	if errors.Is(err, errNotEncodable) {
+		return h.failedStatus(msg, "Message Not Encodable", err), nil
+	}
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	// moderate exactly what we'll send, as placeholders and transliteration can both change what the text says
+	if err := h.moderate(msg.Channel(), text); err != nil {
+		return h.failedStatus(msg, "Message Moderated", err), nil
+	}
+
+	// Mista silently drops characters it can't encode, so make sure that doesn't go unnoticed
+	var encodingLog *courier.ChannelLog
+	if unencodable := unencodableChars(text); msgType == "unicode" && len(unencodable) > 0 {
+		err := fmt.Errorf("message contains characters which can't be encoded: %s", strings.Join(unencodable, ", "))
+
+		switch msg.Channel().StringConfigForKey(configUnencodablePolicy, unencodablePolicyWarn) {
+		case unencodablePolicyFail:
+			return h.failedStatus(msg, "Message Not Encodable", err), nil
+		default:
+			encodingLog = courier.NewChannelLogFromError("Message Not Encodable", msg.Channel(), msg.ID(), 0, err)
+		}
+	}
+
+	// check our message won't exceed the maximum number of segments
+	unicode := msgType == "unicode"
+	maxSegments := msg.Channel().IntConfigForKey(configMaxSegments, defaultMaxSegments)
+	if segments := segmentCount(text, unicode); segments > maxSegments {
+		switch msg.Channel().StringConfigForKey(configSegmentPolicy, segmentPolicyReject) {
+		case segmentPolicyTruncate:
+			text = truncateToSegments(text, unicode, maxSegments)
+		case segmentPolicySend:
+		default:
+			return h.failedStatus(msg, "Message Too Long", fmt.Errorf("message would be sent as %d segments, more than the maximum of %d", segments, maxSegments)), nil
+		}
 	}
 
-	// Build our request
-	form := RequestParams{
-		Recipient: msg.URN().Path(),
-		SenderID:  msg.Channel().Address(),
-		Message:   msg.Text(),
-		Type:      "plain",
+	// when auto-splitting each part is sent and billed as a separate message, so cap how many we'll send
+	parts := []string{text}
+	if msg.Channel().BoolConfigForKey(configSplitMessages, false) {
+		singleSegment, _ := segmentSizes(unicode)
+		maxLength := msg.Channel().IntConfigForKey(courier.ConfigMaxLength, singleSegment)
+
+		switch strategy := msg.Channel().StringConfigForKey(configSplitStrategy, splitStrategyWord); strategy {
+		case splitStrategyWord:
+			parts = handlers.SplitMsgByChannel(msg.Channel(), text, maxLength)
+		case splitStrategyHard:
+			parts = splitHard(text, maxLength)
+		default:
+			return nil, h.sendFailure(msg, sendPhaseBuild, fmt.Errorf("unknown split strategy '%s', must be one of '%s' or '%s'", strategy, splitStrategyWord, splitStrategyHard))
+		}
+
+		maxParts := msg.Channel().IntConfigForKey(configMaxParts, defaultMaxParts)
+		if len(parts) > maxParts {
+			return h.failedStatus(msg, "Message Too Long", fmt.Errorf("message would be sent as %d parts, more than the maximum of %d", len(parts), maxParts)), nil
+		}
 	}
 
-	marshalled, err := json.Marshal(form)
+	// make sure we never send our API key anywhere unexpected
+	endpoints := sendURLsForChannel(msg.Channel(), recipient)
+	insecure := msg.Channel().BoolConfigForKey(configInsecure, false)
+	for _, endpoint := range endpoints {
+		if err := validateSendURL(endpoint, insecure); err != nil {
+			return nil, h.sendFailure(msg, sendPhaseBuild, err)
+		}
+	}
+
+	// likewise make sure we can connect the way the channel requires before we send anything
+	if _, err := h.clientForChannel(msg.Channel()); err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	// build the requests for each of our parts up front so we don't send anything if one can't be built, including
+	// those from our fallback sender if we have one
+	requests, err := h.buildSendRequests(msg, metadata, apiKey, msg.Channel().Address(), recipient, parts, msgType)
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	// Mista rejects messages sent as more requests than the account allows partway through sending them, so make sure
+	// we fail early instead, counting every request including those for separately sent attachments
+	if maxBatch := msg.Channel().IntConfigForKey(configMaxBatchSize, 0); maxBatch > 0 && len(requests) > maxBatch {
+		return h.failedStatus(msg, "Batch Too Large", fmt.Errorf("message would be sent as %d requests, more than the maximum batch size of %d", len(requests), maxBatch)), nil
+	}
+	var fallbackRequests []*sendRequest
+	fallbackSender := msg.Channel().StringConfigForKey(configFallbackSender, "")
+	if fallbackSender != "" {
+		fallbackRequests, err = h.buildSendRequests(msg, metadata, apiKey, fallbackSender, recipient, parts, msgType)
+		if err != nil {
+			return nil, h.sendFailure(msg, sendPhaseBuild, err)
+		}
+	}
+
+	// parts are sent one after another unless the channel would rather trade their order for speed
+	concurrency := msg.Channel().StringConfigForKey(configPartConcurrency, partConcurrencySequential)
+	if concurrency != partConcurrencySequential && concurrency != partConcurrencyConcurrent {
+		return nil, h.sendFailure(msg, sendPhaseBuild, fmt.Errorf("unknown part concurrency '%s', must be one of '%s' or '%s'", concurrency, partConcurrencySequential, partConcurrencyConcurrent))
+	}
+
+	release, err := h.acquireSendSlot(ctx, msg.Channel())
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	// record our status, logging each attempt against it
+	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+	if encodingLog != nil {
+		status.AddLog(encodingLog)
+	}
+
+	chunkSize := 1
+	if concurrency == partConcurrencyConcurrent {
+		chunkSize = msg.Channel().IntConfigForKey(configPartChunkSize, defaultPartChunkSize)
+	}
+	results, errs := h.sendParts(ctx, msg, status, endpoints, requests, fallbackRequests, fallbackSender, chunkSize)
 
-	body := bytes.NewReader(marshalled)
+	for i, result := range results {
+		if err := errs[i]; err != nil {
+			var rejectErr *rejectionError
 
-	req, err := http.NewRequest(http.MethodPost, sendURL, body)
+			// if Mista accepted our message but we couldn't understand its response, leave it errored
+			var sendErr *sendError
+			if errors.As(err, &sendErr) && sendErr.phase == sendPhaseParse {
+				status.AddLog(courier.NewChannelLogFromError("Response Parse Error", msg.Channel(), msg.ID(), 0, err))
+				return status, nil
+			}
+
+			// sandbox accounts can only send to verified numbers, so retrying won't help until the number is verified
+			if errors.As(err, &rejectErr) && sandboxRestrictionRegex.MatchString(rejectErr.body) {
+				status.SetStatus(courier.MsgFailed)
+				status.AddLog(courier.NewChannelLogFromError("Sandbox Recipient Not Verified", msg.Channel(), msg.ID(), 0, errors.New("sandbox recipient not verified")))
+				return status, nil
+			}
+
+			// recipients who have blocked us will stay blocked, so fail rather than retry and remember them, though a
+			// rejection of our sender says nothing about the recipient
+			senderRejected := errors.As(err, &rejectErr) && senderRejectedRegex.MatchString(rejectErr.body)
+			if suppressBlocked && !senderRejected && errors.As(err, &rejectErr) && blockedRecipientRegex.MatchString(rejectErr.body) {
+				h.suppress(msg.Channel(), recipient)
+				status.SetStatus(courier.MsgFailed)
+				status.AddLog(courier.NewChannelLogFromError("Recipient Blocked", msg.Channel(), msg.ID(), 0, err))
+				return status, nil
+			}
+
+			// once some parts have gone out, retrying would send them again, so fail with a record of what was sent
+			if sent, uids := sentParts(results, errs); sent > 0 {
+				status.SetStatus(courier.MsgFailed)
+				if len(uids) > 0 {
+					status.SetExternalID(uids[0])
+				}
+				err := fmt.Errorf("part %d of %d failed after %d were sent with UIDs [%s]: %s", i+1, len(results), sent, strings.Join(uids, ", "), err)
+				status.AddLog(courier.NewChannelLogFromError("Partial Send", msg.Channel(), msg.ID(), 0, err))
+				return status, nil
+			}
+			return nil, err
+		}
+
+		// Mista tells us our remaining balance on each send, use that to warn before it runs out
+		if result.balance != nil {
+			if alert := h.checkBalance(msg.Channel(), *result.balance); alert != nil {
+				status.AddLog(alert)
+			}
+		}
+
+		// a UID we already have for another message means Mista is replaying or reusing UIDs, and statuses for it
+		// could be applied to the wrong message
+		if result.uid != "" {
+			if other := h.recentUIDs.record(msg.Channel(), result.uid, msg.ID(), i+1, len(results)); other != courier.NilMsgID {
+				err := fmt.Errorf("UID '%s' was already returned for message %s", result.uid, other)
+				status.AddLog(courier.NewChannelLogFromError("Duplicate UID", msg.Channel(), msg.ID(), 0, err))
+				logrus.WithField("channel_uuid", msg.Channel().UUID().String()).WithField("msg_id", msg.ID().String()).WithError(err).Warn("duplicate UID returned by Mista")
+			}
+		}
+
+		// our external ID is the UID of our first part
+		if i == 0 {
+			status.SetExternalID(result.uid)
+		}
+	}
+
+	status.SetStatus(acceptedStatus(msg.Channel()))
+
+	// remember when every part was sent so that the delivery of each can be measured
+	sentOn := time.Now()
+	for _, result := range results {
+		h.sendTimes.record(msg.Channel(), msg.ID(), result.uid, sentOn)
+	}
+
+	// high volume channels can keep logs for only some of their successful sends, anything going wrong is always logged
+	if !h.logSampler.sample(msg.Channel(), msg.Channel().IntConfigForKey(configLogSampleRate, 1)) {
+		status = h.withoutSuccessLogs(msg, status)
+	}
+
+	// messages sent with several requests are billed for each of them, so always record what the whole message cost
+	if billing := aggregateBilling(results); billing != nil {
+		status.AddLog(courier.NewChannelLog("Send Cost", msg.Channel(), msg.ID(), "", "", 0, "", billing.String(), 0, nil))
+	}
+	return status, nil
+}
+
+// acquireSendSlot waits until the passed in channel can make a send, staying within the rate Mista allows it to send at
+// and taking turns fairly with other channels, returning a func to call once the send is complete
+func (h *handler) acquireSendSlot(ctx context.Context, channel courier.Channel) (func(), error) {
+	if err := h.throttle(ctx, channel); err != nil {
+		return nil, err
+	}
+
+	dequeued := h.metrics.sendQueued(channel)
+	release, err := h.scheduler.acquire(ctx, channel.UUID().String())
+	dequeued()
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", apiKey)
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
+	completed := h.metrics.sendStarted(channel)
+	return func() {
+		completed()
+		release()
+	}, nil
+}
+
+// sentParts returns how many of the parts of a message Mista accepted and the UIDs it gave those that it did
+func sentParts(results []*sendResult, errs []error) (int, []string) {
+	sent := 0
+	uids := make([]string, 0, len(results))
+	for i, result := range results {
+		if result == nil || errs[i] != nil {
+			continue
+		}
+		sent++
+		if result.uid != "" {
+			uids = append(uids, result.uid)
+		}
+	}
+	return sent, uids
+}
+
+// sendBilling is what Mista billed us for all the requests a message was sent with
+type sendBilling struct {
+	Cost     float64 `json:"cost"`
+	Parts    int     `json:"parts"`
+	Requests int     `json:"requests"`
+}
+
+func (b *sendBilling) String() string {
+	marshalled, _ := json.Marshal(b)
+	return string(marshalled)
+}
+
+// aggregateBilling sums the costs and parts Mista reported for each of the passed in send results, returning nil if
+// it didn't report any costs
+func aggregateBilling(results []*sendResult) *sendBilling {
+	var billing *sendBilling
+	for _, result := range results {
+		if result == nil || result.cost == nil {
+			continue
+		}
+		if billing == nil {
+			billing = &sendBilling{}
+		}
+		billing.Cost += *result.cost
+		billing.Parts += result.parts
+		billing.Requests++
+	}
+	return billing
+}
+
+// buildSendRequests builds the requests to send each of the passed in parts of a message from the given sender to
+// the given recipient. Attachments go with the first part, unless the channel sends each attachment separately in
+// which case the first part carries the first attachment and each of the rest gets a request of its own.
+func (h *handler) buildSendRequests(msg courier.Msg, metadata *msgMetadata, apiKey string, sender string, recipient string, parts []string, msgType string) ([]*sendRequest, error) {
+	mediaURLs := make([]string, len(msg.Attachments()))
+	for i, attachment := range msg.Attachments() {
+		_, mediaURLs[i] = handlers.SplitAttachment(attachment)
+	}
+
+	media := make([][]string, len(parts))
+	media[0] = mediaURLs
+	if msg.Channel().BoolConfigForKey(configSplitAttachments, false) && len(mediaURLs) > 1 {
+		media[0] = mediaURLs[:1]
+		for _, mediaURL := range mediaURLs[1:] {
+			parts = append(parts, "")
+			media = append(media, []string{mediaURL})
+		}
+	}
+
+	// deployments which can't store numbers mustn't have them in their logs either
+	redact, err := recipientRedactor(msg.Channel(), recipient)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if resp != nil {
-			resp.Body.Close()
+
+	requests := make([]*sendRequest, len(parts))
+	for i, part := range parts {
+		request, err := h.buildSendRequest(msg, metadata, apiKey, sender, recipient, i, part, media[i], msgType)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		request.redact = redact
+		requests[i] = request
+	}
+	return requests, nil
+}
 
-	// Check if the response is nil
-	if resp == nil {
-		return nil, errors.New("nil response received")
+// buildSendRequest builds the request to send the passed in text and media as the given part of a message
+func (h *handler) buildSendRequest(msg courier.Msg, metadata *msgMetadata, apiKey string, sender string, recipient string, part int, text string, media []string, msgType string) (*sendRequest, error) {
+	payload := &mtPayload{
+		Recipient: recipient,
+		SenderID:  sender,
+		Message:   text,
+		Type:      msgType,
+		Metadata:  metadata.Metadata,
+		Reference: msg.ID().String(),
+		SessionID: metadata.SessionID,
+		DLR:       requestDLR(msg, metadata),
 	}
 
-	// Read the response body
-	respBody, err := ioutil.ReadAll(resp.Body)
+	// populate whichever reference fields this channel wants Mista to carry through, defaulting to our message UUID
+	for _, field := range stringListConfigForKey(msg.Channel(), configReferenceFields) {
+		value := metadata.reference(field)
+		if value == "" {
+			value = msg.UUID().String()
+		}
+
+		switch field {
+		case "client_ref":
+			payload.ClientRef = value
+		case "custom":
+			payload.Custom = value
+		case "tag":
+			payload.Tag = value
+		default:
+			return nil, fmt.Errorf("unknown reference field '%s', must be one of 'client_ref', 'custom' or 'tag'", field)
+		}
+	}
+
+	// tag and label our traffic so it can be segmented in Mista's dashboard, unless the tag is already a reference
+	if payload.Tag == "" {
+		payload.Tag = firstNonEmpty(metadata.Tag, msg.Channel().StringConfigForKey(configTag, ""))
+	}
+	payload.Label = firstNonEmpty(metadata.Label, msg.Channel().StringConfigForKey(configLabel, ""))
+
+	// attachments are sent as an MMS, with text Mista can send instead to handsets which can't receive it
+	if len(media) > 0 {
+		payload.Media = media
+		fallback, _ := metadata.Attributes[configMMSFallbackText].(string)
+		payload.Fallback = firstNonEmpty(fallback, msg.Channel().StringConfigForKey(configMMSFallbackText, ""))
+	}
+
+	body, contentType, err := encodeSendBody(payload, msg.Channel().StringConfigForKey(configSendEncoding, sendEncodingJSON))
 	if err != nil {
 		return nil, err
 	}
 
-	// Check the response status code
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("SMS request failed with status code: %d", resp.StatusCode)
+	request := &sendRequest{
+		body: body,
+		headers: map[string]string{
+			"Accept":        "application/json",
+			"Content-Type":  contentType,
+			"Authorization": apiKey,
+		},
+	}
+	if msg.Channel().BoolConfigForKey(configIdempotencyKey, false) {
+		request.headers["Idempotency-Key"] = h.idempotencyKey(msg.Channel(), msg.ID(), sender, part)
 	}
 
-	// record our status and log the error
-	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	status.AddLog(courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), nil).WithError("Message Send Error", err))
+	request.timeout = sendTimeout(msg, metadata)
 
-	// Parse the response body to extract the necessary information
-	var responseData struct {
-		Status string `json:"status"`
-		UID    string `json:"uid"`
+	// only compress payloads large enough for it to be worth it
+	if msg.Channel().BoolConfigForKey(configCompressRequests, false) && len(body) >= msg.Channel().IntConfigForKey(configCompressMinSize, defaultCompressMinSize) {
+		if err := request.compress(); err != nil {
+			return nil, err
+		}
 	}
+	return request, nil
+}
 
-	err = json.Unmarshal(respBody, &responseData)
+// sendTimeout returns how long we give each request to send the passed in message, which can be less (or more)
+// depending on its priority
+func sendTimeout(msg courier.Msg, metadata *msgMetadata) time.Duration {
+	if timeout, found := durationMapConfigForKey(msg.Channel(), configPriorityTimeouts)[msgPriority(msg, metadata)]; found {
+		return timeout
+	}
+	return time.Duration(msg.Channel().IntConfigForKey(configSendTimeout, defaultSendTimeout)) * time.Second
+}
+
+// msgMetadata is the part of an outgoing message's metadata that we make use of when sending
+type msgMetadata struct {
+	Metadata   map[string]interface{} `json:"metadata"`
+	ClientRef  string                 `json:"client_ref"`
+	Custom     string                 `json:"custom"`
+	Tag        string                 `json:"tag"`
+	Label      string                 `json:"label"`
+	SessionID  string                 `json:"session_id"`
+	Priority   string                 `json:"priority"`
+	Attributes map[string]interface{} `json:"attributes"`
+	RequestDLR *bool                  `json:"request_dlr"`
+}
+
+// reference returns the value in our metadata for the passed in reference field
+func (m *msgMetadata) reference(field string) string {
+	switch field {
+	case "client_ref":
+		return m.ClientRef
+	case "custom":
+		return m.Custom
+	case "tag":
+		return m.Tag
+	}
+	return ""
+}
+
+// originCountry returns the ISO country code of the passed in tel URN, which is already normalized to E164, or empty
+// string if it can't be determined
+func originCountry(urn urns.URN) string {
+	number, err := phonenumbers.Parse(urn.Path(), "")
 	if err != nil {
-		return status, nil
+		return ""
+	}
+	country := phonenumbers.GetRegionCodeForNumber(number)
+	if country == "ZZ" {
+		return ""
 	}
+	return country
+}
 
-	// Create the message status based on the response data
-	status.SetStatus(courier.MsgWired)
-	status.SetExternalID(responseData.UID)
+// isLandline returns whether the passed in E164 number is known to be a landline, numbers which could be either a
+// landline or a mobile being given the benefit of the doubt
+func isLandline(number string) bool {
+	parsed, err := phonenumbers.Parse(number, "")
+	if err != nil {
+		return false
+	}
+	return phonenumbers.GetNumberType(parsed) == phonenumbers.FIXED_LINE
+}
 
-	return status, nil
+// requestDLR returns whether we ask Mista for a delivery report for the passed in message, which some plans charge
+// extra for, with the flow able to override the channel
+func requestDLR(msg courier.Msg, metadata *msgMetadata) bool {
+	if metadata.RequestDLR != nil {
+		return *metadata.RequestDLR
+	}
+	return msg.Channel().BoolConfigForKey(configRequestDLR, true)
+}
+
+// msgPriority returns the priority of the passed in outgoing message, which can be set explicitly in its metadata
+func msgPriority(msg courier.Msg, metadata *msgMetadata) string {
+	if metadata.Priority != "" {
+		return metadata.Priority
+	}
+	if msg.HighPriority() {
+		return priorityHigh
+	}
+	return priorityNormal
+}
+
+// parseMsgMetadata parses the metadata of the passed in outgoing message
+func parseMsgMetadata(msg courier.Msg) (*msgMetadata, error) {
+	metadata := &msgMetadata{}
+	if len(msg.Metadata()) == 0 {
+		return metadata, nil
+	}
+	if err := json.Unmarshal(msg.Metadata(), metadata); err != nil {
+		return nil, fmt.Errorf("unable to parse message metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// acceptedStatus returns the status of messages Mista has accepted on the passed in channel, which some operators
+// consider sent rather than just wired
+func acceptedStatus(channel courier.Channel) courier.MsgStatusValue {
+	if channel.BoolConfigForKey(configAcceptAsSent, false) {
+		return courier.MsgSent
+	}
+	return courier.MsgWired
+}
+
+// failedStatus returns a failed status for the passed in message, logging the reason it couldn't be sent
+func (h *handler) failedStatus(msg courier.Msg, description string, err error) courier.MsgStatus {
+	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgFailed)
+	status.AddLog(courier.NewChannelLogFromError(description, msg.Channel(), msg.ID(), 0, err))
+	return status
+}
+
+// encodeText prepares the passed in text to be sent on the channel, returning it with the message type it should be
+// sent as. We try each of the channel's preferred encodings in order, by default sending as GSM7 if we can, optionally
+// transliterating to get there, otherwise falling back to unicode.
+func encodeText(channel courier.Channel, text string) (string, string, error) {
+	text, err := applyNewlineMode(text, channel.StringConfigForKey(configNewlineMode, newlineModeRaw))
+	if err != nil {
+		return "", "", err
+	}
+
+	order := stringListConfigForKey(channel, configEncodingOrder)
+	if len(order) == 0 {
+		order = defaultEncodingOrder
+	}
+
+	for _, encoding := range order {
+		switch strings.ToLower(encoding) {
+		case encodingGSM:
+			if gsm7.IsValid(text) {
+				return text, "plain", nil
+			}
+			if channel.BoolConfigForKey(configTransliterate, false) {
+				if transliterated, valid := transliterate(text); valid {
+					return transliterated, "plain", nil
+				}
+			}
+		case encodingUCS2:
+			return text, "unicode", nil
+		default:
+			return "", "", fmt.Errorf("unknown encoding '%s' in encoding order, must be one of '%s' or '%s'", encoding, encodingGSM, encodingUCS2)
+		}
+	}
+	return "", "", fmt.Errorf("%w using any of the encodings %s", errNotEncodable, strings.Join(order, ", "))
+}
+
+// errNotEncodable is returned when a message can't be sent with any of a channel's encodings
+var errNotEncodable = errors.New("message can't be sent")
+
+// applyNewlineMode converts the newlines in the passed in text according to the given mode
+func applyNewlineMode(text string, mode string) (string, error) {
+	switch mode {
+	case newlineModeRaw:
+		return text, nil
+	case newlineModeCRLF:
+		return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n"), nil
+	case newlineModeStrip:
+		// replace line breaks with spaces so that words either side don't run together
+		return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(text), nil
+	}
+	return "", fmt.Errorf("unknown newline mode '%s', must be one of 'raw', 'crlf' or 'strip'", mode)
+}
+
+// firstNonEmpty returns the first of the passed in values which isn't empty
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
 }
@@ -0,0 +1,3722 @@
+package mista
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/test"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	channelUUID = "8eb23e93-5ecb-45ba-b726-3b064e0c56ab"
+	receiveURL  = "/c/mx/" + channelUUID + "/receive"
+	statusURL   = "/c/mx/" + channelUUID + "/status"
+	ussdURL     = "/c/mx/" + channelUUID + "/ussd"
+)
+
+var testChannels = []courier.Channel{
+	test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY"}),
+}
+
+const (
+	blocklistChannelUUID = "a1d7a2b0-8b3a-4d0e-9a49-3affa7c0b3e1"
+	blocklistReceiveURL  = "/c/mx/" + blocklistChannelUUID + "/receive"
+)
+
+var blocklistChannels = []courier.Channel{
+	test.NewMockChannel(blocklistChannelUUID, "MX", "2020", "RW", map[string]interface{}{
+		courier.ConfigAPIKey: "KEY",
+		configBlocklist:      []interface{}{"won", `bit\.ly/\w+`},
+	}),
+}
+
+var handleTestCases = []ChannelHandleTestCase{
+	{Label: "Receive Valid Message", URL: receiveURL, Data: "id=123&body=Join&from=%2B250788383383&to=2020",
+		Status: 200, Response: "Message Accepted", Text: Sp("Join"), URN: Sp("tel:+250788383383"), External: Sp("123")},
+	{Label: "Receive Missing Body", URL: receiveURL, Data: "id=123&from=%2B250788383383&to=2020",
+		Status: 400, Response: "field 'body' is required"},
+
+	{Label: "Ignore Outbound Echo By Direction", URL: receiveURL, Data: "id=124&body=Hi+there&from=2020&to=%2B250788383383&direction=outbound",
+		Status: 200, Response: "ignoring outbound message echo"},
+	{Label: "Ignore Outbound Echo By SMS Type", URL: receiveURL, Data: "id=125&body=Hi+there&from=2020&to=%2B250788383383&sms_type=MT",
+		Status: 200, Response: "ignoring outbound message echo"},
+	{Label: "Receive Inbound Direction", URL: receiveURL, Data: "id=126&body=Hello&from=%2B250788383383&to=2020&direction=inbound",
+		Status: 200, Response: "Message Accepted", Text: Sp("Hello")},
+
+	{Label: "Receive UCS-2 Hex Body", URL: receiveURL, Data: "id=127&body=004800e900200633064406270645&from=%2B250788383383&to=2020&encoding=ucs2",
+		Status: 200, Response: "Message Accepted", Text: Sp("Hé سلام")},
+	{Label: "Receive UCS-2 Hex Body By Data Coding", URL: receiveURL, Data: "id=128&body=00480069&from=%2B250788383383&to=2020&encoding=8",
+		Status: 200, Response: "Message Accepted", Text: Sp("Hi")},
+	{Label: "Receive Latin-1 Body", URL: receiveURL, Data: "id=129&body=caf%E9&from=%2B250788383383&to=2020&encoding=latin1",
+		Status: 200, Response: "Message Accepted", Text: Sp("café")},
+	{Label: "Receive Invalid UCS-2 Hex Body", URL: receiveURL, Data: "id=130&body=00480&from=%2B250788383383&to=2020&encoding=ucs2",
+		Status: 400, Response: "invalid UCS-2 hex body"},
+	{Label: "Receive Unsupported Encoding", URL: receiveURL, Data: "id=131&body=Hi&from=%2B250788383383&to=2020&encoding=ebcdic",
+		Status: 400, Response: "unsupported encoding 'ebcdic'"},
+
+	{Label: "Receive Padded Body", URL: receiveURL, Data: "id=132&body=+%0A+JOIN++now%09+&from=%2B250788383383&to=2020",
+		Status: 200, Response: "Message Accepted", Text: Sp("JOIN  now")},
+}
+
+var blocklistTestCases = []ChannelHandleTestCase{
+	{Label: "Receive Allowed Message", URL: blocklistReceiveURL, Data: "id=123&body=Hello+there&from=%2B250788383383&to=2020",
+		Status: 200, Response: "Message Accepted", Text: Sp("Hello there")},
+	{Label: "Ignore Blocklisted Keyword", URL: blocklistReceiveURL, Data: "id=124&body=You+WON+a+prize&from=%2B250788383383&to=2020",
+		Status: 200, Response: "ignoring message matching blocklist"},
+	{Label: "Ignore Blocklisted Pattern", URL: blocklistReceiveURL, Data: "id=125&body=visit+bit.ly/abc&from=%2B250788383383&to=2020",
+		Status: 200, Response: "ignoring message matching blocklist"},
+}
+
+var statusTestCases = []ChannelHandleTestCase{
+	{Label: "Status With Valid Reference", URL: statusURL, Data: "id=mx123&status=Success&reference=10", NoQueueErrorCheck: true,
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("D")},
+	{Label: "Status Without Reference", URL: statusURL, Data: "id=mx123&status=Success",
+		Status: 200, Response: "Status Update Accepted", External: Sp("mx123"), MsgStatus: Sp("D")},
+	{Label: "Status With Malformed Reference", URL: statusURL, Data: "id=mx123&status=Success&reference=msg-10",
+		Status: 400, Response: "invalid reference 'msg-10', must be a message ID"},
+	{Label: "Status With Negative Reference", URL: statusURL, Data: "id=mx123&status=Success&reference=-10",
+		Status: 400, Response: "invalid reference '-10', must be a message ID"},
+	{Label: "Status Missing ID", URL: statusURL, Data: "status=Success",
+		Status: 400, Response: "field 'id' is required"},
+	{Label: "Unknown Status", URL: statusURL, Data: "id=mx123&status=Lost",
+		Status: 400, Response: "unknown status 'Lost'"},
+	{Label: "Status Delivered To Network", URL: statusURL, Data: "id=mx123&status=DeliveredToNetwork&reference=10",
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("S")},
+	{Label: "Status Delivered To Handset", URL: statusURL, Data: "id=mx123&status=DeliveredToHandset&reference=10",
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("D")},
+	{Label: "Numeric Status", URL: statusURL, Data: "id=mx123&status=8&reference=10",
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("S")},
+	{Label: "Numeric Failed Status", URL: statusURL, Data: "id=mx123&status=16&reference=10",
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("F")},
+	{Label: "Unknown Numeric Status", URL: statusURL, Data: "id=mx123&status=64&reference=10",
+		Status: 400, Response: "unknown status '64'"},
+	{Label: "Read Receipt", URL: statusURL, Data: "id=mx123&status=Read&reference=10",
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("D")},
+	{Label: "Success Only Confirmed By Network", URL: statusURL, Data: "id=mx123&status=Success&reference=10&delivered_to=network",
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("S")},
+}
+
+const (
+	unvalidatedChannelUUID = "2f1f7c0e-3c9e-4b8e-8d0a-7f3c5a8e9b21"
+	unvalidatedStatusURL   = "/c/mx/" + unvalidatedChannelUUID + "/status"
+)
+
+var unvalidatedChannels = []courier.Channel{
+	test.NewMockChannel(unvalidatedChannelUUID, "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY", configValidateReference: false}),
+}
+
+var unvalidatedStatusTestCases = []ChannelHandleTestCase{
+	{Label: "Malformed Reference Matched On UID", URL: unvalidatedStatusURL, Data: "id=mx123&status=Success&reference=msg-10", NoQueueErrorCheck: true,
+		Status: 200, Response: "Status Update Accepted", External: Sp("mx123"), MsgStatus: Sp("D")},
+}
+
+var ussdTestCases = []ChannelHandleTestCase{
+	{Label: "USSD Session Start", URL: ussdURL, Data: "session_id=s1&event=start&from=%2B250788383383&to=2020&service_code=*123%23", NoQueueErrorCheck: true,
+		Status: 200, Response: "Event Accepted", ChannelEvent: Sp("new_conversation"), URN: Sp("tel:+250788383383"),
+		ChannelEventExtra: map[string]interface{}{"session_id": "s1", "service_code": "*123#"}},
+	{Label: "USSD Session Continue", URL: ussdURL, Data: "session_id=s1&event=continue&from=%2B250788383383&to=2020&text=1",
+		Status: 200, Response: "Message Accepted", Text: Sp("1"), URN: Sp("tel:+250788383383")},
+	{Label: "USSD Session End", URL: ussdURL, Data: "session_id=s1&event=end&from=%2B250788383383&to=2020",
+		Status: 200, Response: "ignoring USSD session end"},
+	{Label: "USSD Unknown Event", URL: ussdURL, Data: "session_id=s1&event=timeout&from=%2B250788383383&to=2020",
+		Status: 400, Response: "unknown USSD event 'timeout'"},
+	{Label: "USSD Missing Session", URL: ussdURL, Data: "event=start&from=%2B250788383383&to=2020",
+		Status: 400, Response: "field 'session_id' is required"},
+}
+
+const (
+	mappedChannelUUID = "5b1f4b6c-0f34-4a5e-a1d1-2f8f0c9c7d10"
+	mappedReceiveURL  = "/c/mx/" + mappedChannelUUID + "/receive"
+)
+
+var mappedChannels = []courier.Channel{
+	test.NewMockChannel(mappedChannelUUID, "MX", "2020", "RW", map[string]interface{}{
+		courier.ConfigAPIKey: "KEY",
+		configFieldMapping: map[string]interface{}{
+			"id":   "/message/id",
+			"body": "/message/content/text",
+			"from": "/message/sender/msisdn",
+			"to":   "/message/recipients/0",
+		},
+	}),
+}
+
+var mappedTestCases = []ChannelHandleTestCase{
+	{Label: "Receive Nested JSON", URL: mappedReceiveURL,
+		Data:   `{"message":{"id":123,"content":{"text":"Join"},"sender":{"msisdn":"+250788383383"},"recipients":["2020"]}}`,
+		Status: 200, Response: "Message Accepted", Text: Sp("Join"), URN: Sp("tel:+250788383383"), External: Sp("123")},
+	{Label: "Receive Nested JSON Missing Body", URL: mappedReceiveURL,
+		Data:   `{"message":{"id":123,"content":{},"sender":{"msisdn":"+250788383383"},"recipients":["2020"]}}`,
+		Status: 400, Response: "field 'body' is required"},
+	{Label: "Receive Invalid JSON", URL: mappedReceiveURL, Data: `{"message":`,
+		Status: 400, Response: "unable to parse request JSON"},
+}
+
+var simulateDLRTestCases = []ChannelHandleTestCase{
+	{Label: "Simulate DLR", URL: "/c/mx/" + channelUUID + "/simulate_dlr", Data: "id=mx123&status=Success&reference=10", NoQueueErrorCheck: true,
+		Status: 200, Response: "Status Update Accepted", ID: 10, MsgStatus: Sp("D")},
+	{Label: "Simulate Failed DLR", URL: "/c/mx/" + channelUUID + "/simulate_dlr", Data: "id=mx123&status=Failed",
+		Status: 200, Response: "Status Update Accepted", External: Sp("mx123"), MsgStatus: Sp("F")},
+}
+
+var noSimulateDLRTestCases = []ChannelHandleTestCase{
+	{Label: "Simulate DLR Not Routed", URL: "/c/mx/" + channelUUID + "/simulate_dlr", Data: "id=mx123&status=Success&reference=10",
+		NoQueueErrorCheck: true, NoInvalidChannelCheck: true, Status: 404},
+}
+
+func TestDebugRoutes(t *testing.T) {
+	RunChannelTestCases(t, testChannels, newHandler(), noSimulateDLRTestCases)
+
+	defer func() { debugRoutes = false }()
+	debugRoutes = true
+	RunChannelTestCases(t, testChannels, newHandler(), simulateDLRTestCases)
+}
+
+const (
+	systemChannelUUID = "c6a0d5e2-7f0b-4d9c-9e55-1b2a3c4d5e6f"
+	systemReceiveURL  = "/c/mx/" + systemChannelUUID + "/receive"
+)
+
+var systemChannels = []courier.Channel{
+	test.NewMockChannel(systemChannelUUID, "MX", "2020", "RW", map[string]interface{}{
+		courier.ConfigAPIKey: "KEY",
+		configSystemMessages: []interface{}{"^delivery receipt", "maintenance"},
+	}),
+}
+
+var systemTestCases = []ChannelHandleTestCase{
+	{Label: "Receive Message With Sender", URL: systemReceiveURL, Data: "id=123&body=Join&from=%2B250788383383&to=2020",
+		Status: 200, Response: "Message Accepted", Text: Sp("Join")},
+	{Label: "Ignore Empty From System Record", URL: systemReceiveURL, Data: "id=124&body=Scheduled+maintenance+tonight&from=&to=2020",
+		Status: 200, Response: "ignoring system message without sender"},
+	{Label: "Reject Unexpected Empty From", URL: systemReceiveURL, Data: "id=125&body=Join&from=&to=2020",
+		Status: 400, Response: "field 'from' required"},
+}
+
+const (
+	emptyFromChannelUUID = "5d3c2b1a-9e8f-4a7b-8c6d-0e1f2a3b4c5d"
+	emptyFromReceiveURL  = "/c/mx/" + emptyFromChannelUUID + "/receive"
+)
+
+var emptyFromChannels = []courier.Channel{
+	test.NewMockChannel(emptyFromChannelUUID, "MX", "2020", "RW", map[string]interface{}{
+		courier.ConfigAPIKey:  "KEY",
+		configSystemMessages:  []interface{}{"maintenance"},
+		configAcceptEmptyFrom: true,
+		configSystemSender:    "mista-alerts",
+	}),
+}
+
+var emptyFromTestCases = []ChannelHandleTestCase{
+	{Label: "Receive Empty From As System URN", URL: emptyFromReceiveURL, Data: "id=123&body=Your+balance+is+low&from=&to=2020",
+		Status: 200, Response: "Message Accepted", Text: Sp("Your balance is low"), URN: Sp("ext:mista-alerts")},
+	{Label: "Ignore Expected System Record", URL: emptyFromReceiveURL, Data: "id=124&body=Scheduled+maintenance+tonight&from=&to=2020",
+		Status: 200, Response: "ignoring system message without sender"},
+	{Label: "Receive Message With Sender", URL: emptyFromReceiveURL, Data: "id=125&body=Join&from=%2B250788383383&to=2020",
+		Status: 200, Response: "Message Accepted", Text: Sp("Join"), URN: Sp("tel:+250788383383")},
+}
+
+func TestHandler(t *testing.T) {
+	RunChannelTestCases(t, testChannels, newHandler(), handleTestCases)
+	RunChannelTestCases(t, testChannels, newHandler(), statusTestCases)
+	RunChannelTestCases(t, unvalidatedChannels, newHandler(), unvalidatedStatusTestCases)
+	RunChannelTestCases(t, testChannels, newHandler(), ussdTestCases)
+	RunChannelTestCases(t, mappedChannels, newHandler(), mappedTestCases)
+	RunChannelTestCases(t, systemChannels, newHandler(), systemTestCases)
+	RunChannelTestCases(t, emptyFromChannels, newHandler(), emptyFromTestCases)
+	RunChannelTestCases(t, blocklistChannels, newHandler(), blocklistTestCases)
+}
+
+// setBaseURL points the channel at our test server, which being plain http, needs the channel to allow insecure sends
+func setBaseURL(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+	c.(*test.MockChannel).SetConfig(courier.ConfigBaseURL, s.URL)
+}
+
+func newSendChannel(config map[string]interface{}) *test.MockChannel {
+	channelConfig := map[string]interface{}{courier.ConfigAPIKey: "KEY", configInsecure: true}
+	for key, value := range config {
+		channelConfig[key] = value
+	}
+	return test.NewMockChannel(channelUUID, "MX", "2020", "RW", channelConfig)
+}
+
+var defaultSendTestCases = []ChannelSendTestCase{
+	{Label: "Plain Send", Text: "Simple Message", URN: "tel:+250788383383",
+		Status: "W", ExternalID: "mx123", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		Headers:     map[string]string{"Authorization": "Bearer KEY", "Content-Type": "application/json"},
+		RequestBody: `{"recipient":"+250788383383","sender_id":"2020","message":"Simple Message","type":"plain","reference":"10","dlr":true}`,
+		Path:        "/sms", SendPrep: setBaseURL},
+	{Label: "Accented Latin Sent As Unicode", Text: "Ação", URN: "tel:+250788383383",
+		Status: "W", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		RequestBody: `{"recipient":"+250788383383","sender_id":"2020","message":"Ação","type":"unicode","reference":"10","dlr":true}`,
+		SendPrep:    setBaseURL},
+	{Label: "Error Sending", Text: "Error Message", URN: "tel:+250788383383",
+		ResponseBody: `{"error":"failed"}`, ResponseStatus: 401,
+		Error: "transport error: SMS request failed with status code: 401", SendPrep: setBaseURL},
+}
+
+var transliterateSendTestCases = []ChannelSendTestCase{
+	{Label: "Accented Latin Transliterated", Text: "Ação", URN: "tel:+250788383383",
+		Status: "W", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		RequestBody: `{"recipient":"+250788383383","sender_id":"2020","message":"Acao","type":"plain","reference":"10","dlr":true}`,
+		SendPrep:    setBaseURL},
+	{Label: "Untransliterable Sent As Unicode", Text: "Ação ☺", URN: "tel:+250788383383",
+		Status: "W", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		RequestBody: `{"recipient":"+250788383383","sender_id":"2020","message":"Ação ☺","type":"unicode","reference":"10","dlr":true}`,
+		SendPrep:    setBaseURL},
+}
+
+// setSendURLs points the channel's primary and secondary endpoints at our test server
+func setSendURLs(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+	c.(*test.MockChannel).SetConfig(configSendURLs, []interface{}{s.URL + "/primary", s.URL + "/secondary"})
+}
+
+var metadataSendTestCases = []ChannelSendTestCase{
+	{Label: "Metadata Passed Through", Text: "Simple Message", URN: "tel:+250788383383",
+		Metadata: json.RawMessage(`{"metadata":{"campaign":"spring"}}`),
+		Status:   "W", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		RequestBody: `{"recipient":"+250788383383","sender_id":"2020","message":"Simple Message","type":"plain","metadata":{"campaign":"spring"},"reference":"10","dlr":true}`,
+		SendPrep:    setBaseURL},
+	{Label: "Invalid Metadata", Text: "Simple Message", URN: "tel:+250788383383",
+		Metadata: json.RawMessage(`{"metadata":"spring"}`),
+		Error:    "build error: unable to parse message metadata: json: cannot unmarshal string into Go struct field msgMetadata.metadata of type map[string]interface {}",
+		SendPrep: setBaseURL},
+}
+
+var formSendTestCases = []ChannelSendTestCase{
+	{Label: "Form Encoded Send", Text: "Simple Message", URN: "tel:+250788383383",
+		Metadata: json.RawMessage(`{"metadata":{"campaign":"spring"}}`),
+		Status:   "W", ExternalID: "mx123", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+		PostParams: map[string]string{
+			"recipient": "+250788383383",
+			"sender_id": "2020",
+			"message":   "Simple Message",
+			"type":      "plain",
+			"reference": "10",
+			"metadata":  `{"campaign":"spring"}`,
+			"dlr":       "true",
+		},
+		SendPrep: setBaseURL},
+}
+
+var failoverSendTestCases = []ChannelSendTestCase{
+	{Label: "Primary Unavailable, Secondary Accepts", Text: "Simple Message", URN: "tel:+250788383383",
+		Responses: map[MockedRequest]MockedResponse{
+			{Method: "POST", Path: "/primary"}:   {Status: 503, Body: `{"error":"unavailable"}`},
+			{Method: "POST", Path: "/secondary"}: {Status: 200, Body: `{"uid":"mx456"}`},
+		},
+		Status: "W", ExternalID: "mx456", Path: "/secondary", SendPrep: setSendURLs},
+	{Label: "Primary Rejects", Text: "Simple Message", URN: "tel:+250788383383",
+		Responses: map[MockedRequest]MockedResponse{
+			{Method: "POST", Path: "/primary"}:   {Status: 400, Body: `{"error":"invalid recipient"}`},
+			{Method: "POST", Path: "/secondary"}: {Status: 200, Body: `{"uid":"mx456"}`},
+		},
+		Path: "/primary", Error: "transport error: SMS request failed with status code: 400", SendPrep: setSendURLs},
+}
+
+var secureSendTestCases = []ChannelSendTestCase{
+	{Label: "Reject HTTP Send URL", Text: "Simple Message", URN: "tel:+250788383383",
+		Error: "build error: invalid send URL 'http://mista.test/sms': scheme must be https",
+		SendPrep: func(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+			c.(*test.MockChannel).SetConfig(courier.ConfigSendURL, "http://mista.test/sms")
+		}},
+	{Label: "Reject Relative Send URL", Text: "Simple Message", URN: "tel:+250788383383",
+		Error: "build error: invalid send URL '/sms': missing host",
+		SendPrep: func(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+			c.(*test.MockChannel).SetConfig(courier.ConfigSendURL, "/sms")
+		}},
+}
+
+// newlineSendTestCases returns a test case for sending text with newlines which we expect to be sent as the given text
+func newlineSendTestCases(sent string) []ChannelSendTestCase {
+	return []ChannelSendTestCase{
+		{Label: "Newlines", Text: "Hello\r\nthere\nWorld", URN: "tel:+250788383383",
+			Status: "W", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+			RequestBody: `{"recipient":"+250788383383","sender_id":"2020","message":"` + sent + `","type":"plain","reference":"10","dlr":true}`,
+			SendPrep:    setBaseURL},
+	}
+}
+
+var invalidNewlineSendTestCases = []ChannelSendTestCase{
+	{Label: "Unknown Newline Mode", Text: "Hello\nWorld", URN: "tel:+250788383383",
+		Error: "build error: unknown newline mode 'cr', must be one of 'raw', 'crlf' or 'strip'", SendPrep: setBaseURL},
+}
+
+var acceptAsSentSendTestCases = []ChannelSendTestCase{
+	{Label: "Accepted As Sent", Text: "Simple Message", URN: "tel:+250788383383",
+		Status: "S", ExternalID: "mx123", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		RequestBody: `{"recipient":"+250788383383","sender_id":"2020","message":"Simple Message","type":"plain","reference":"10","dlr":true}`,
+		SendPrep:    setBaseURL},
+	{Label: "Rejected Still An Error", Text: "Error Message", URN: "tel:+250788383383",
+		ResponseBody: `{"error":"failed"}`, ResponseStatus: 401,
+		Error: "transport error: SMS request failed with status code: 401", SendPrep: setBaseURL},
+}
+
+var responsePathSendTestCases = []ChannelSendTestCase{
+	{Label: "UID From Nested Path", Text: "Simple Message", URN: "tel:+250788383383",
+		Status: "W", ExternalID: "mx456", ResponseBody: `{"data":{"messages":[{"message_id":"mx456","state":"queued"}]}}`, ResponseStatus: 200,
+		SendPrep: setBaseURL},
+	{Label: "Missing UID Path", Text: "Simple Message", URN: "tel:+250788383383",
+		Status: "W", ExternalID: "", ResponseBody: `{"uid":"mx123"}`, ResponseStatus: 200,
+		SendPrep: setBaseURL},
+	{Label: "Failed Status From Nested Path", Text: "Simple Message", URN: "tel:+250788383383",
+		ResponseBody: `{"data":{"messages":[{"message_id":"mx456","state":"failed"}]}}`, ResponseStatus: 200,
+		Error: `transport error: SMS request failed with status code: 200`, SendPrep: setBaseURL},
+}
+
+func TestSending(t *testing.T) {
+	RunChannelSendTestCases(t, newSendChannel(nil), newHandler(), defaultSendTestCases, nil)
+	RunChannelSendTestCases(t, newSendChannel(map[string]interface{}{configTransliterate: true}), newHandler(), transliterateSendTestCases, nil)
+	RunChannelSendTestCases(t, newSendChannel(nil), newHandler(), metadataSendTestCases, nil)
+	RunChannelSendTestCases(t, newSendChannel(map[string]interface{}{configSendEncoding: sendEncodingForm}), newHandler(), formSendTestCases, nil)
+	RunChannelSendTestCases(t, newSendChannel(nil), newHandler(), failoverSendTestCases, nil)
+	RunChannelSendTestCases(t, newSendChannel(nil), newHandler(), newlineSendTestCases(`Hello\r\nthere\nWorld`), nil)
+	RunChannelSendTestCases(t, newSendChannel(map[string]interface{}{configNewlineMode: newlineModeCRLF}), newHandler(), newlineSendTestCases(`Hello\r\nthere\r\nWorld`), nil)
+	RunChannelSendTestCases(t, newSendChannel(map[string]interface{}{configNewlineMode: newlineModeStrip}), newHandler(), newlineSendTestCases(`Hello there World`), nil)
+	RunChannelSendTestCases(t, newSendChannel(map[string]interface{}{configNewlineMode: "cr"}), newHandler(), invalidNewlineSendTestCases, nil)
+	RunChannelSendTestCases(t, test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY"}), newHandler(), secureSendTestCases, nil)
+	RunChannelSendTestCases(t, newSendChannel(map[string]interface{}{configAcceptAsSent: true}), newHandler(), acceptAsSentSendTestCases, nil)
+	RunChannelSendTestCases(t, newSendChannel(map[string]interface{}{configResponseUIDPath: "data.messages.0.message_id", configResponseStatusPath: "/data/messages/0/state"}), newHandler(), responsePathSendTestCases, nil)
+}
+
+// waitForWaiters waits until the passed in scheduler has the given number of sends waiting for a slot
+func waitForWaiters(t *testing.T, s *fairScheduler, count int) {
+	require.Eventually(t, func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		waiting := 0
+		for _, waiters := range s.queues {
+			waiting += len(waiters)
+		}
+		return waiting == count
+	}, time.Second, time.Millisecond)
+}
+
+func TestFairScheduler(t *testing.T) {
+	ctx := context.Background()
+	s := newFairScheduler(1)
+
+	release, err := s.acquire(ctx, "busy")
+	require.NoError(t, err)
+
+	// a busy channel queues three sends before a quiet channel queues one
+	served := make(chan string, 4)
+	for i, key := range []string{"busy", "busy", "busy", "quiet"} {
+		go func(key string) {
+			release, err := s.acquire(ctx, key)
+			assert.NoError(t, err)
+			served <- key
+			release()
+		}(key)
+		waitForWaiters(t, s, i+1)
+	}
+
+	// the quiet channel shouldn't have to wait behind all of the busy channel's sends
+	release()
+	order := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		order = append(order, <-served)
+	}
+	assert.Equal(t, []string{"busy", "quiet", "busy", "busy"}, order)
+
+	// a waiter which gives up is removed from the line
+	release, err = s.acquire(ctx, "busy")
+	require.NoError(t, err)
+
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = s.acquire(cancelled, "quiet")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	waitForWaiters(t, s, 0)
+	release()
+
+	// without any slots sends are never held up
+	unlimited := newFairScheduler(0)
+	for i := 0; i < 100; i++ {
+		_, err := unlimited.acquire(ctx, "busy")
+		require.NoError(t, err)
+	}
+}
+
+// newTestHandler returns a handler initialized against the passed in backend, for testing it directly rather than
+// through a server
+func newTestHandler(backend courier.Backend) *handler {
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), backend))
+	return h
+}
+
+// newFormRequest returns a new form encoded POST of the passed in data
+func newFormRequest(url string, data string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, url, strings.NewReader(data))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// slowBackend is a mock backend whose first message write is slow, letting us test callbacks retried meanwhile
+type slowBackend struct {
+	*test.MockBackend
+	writing chan struct{}
+	delay   time.Duration
+	writes  int
+}
+
+func (b *slowBackend) WriteMsg(ctx context.Context, msg courier.Msg) error {
+	b.writes++
+	if b.writes == 1 {
+		close(b.writing)
+		time.Sleep(b.delay)
+	}
+	return b.MockBackend.WriteMsg(ctx, msg)
+}
+
+func TestRetriedCallbackDuringSlowWrite(t *testing.T) {
+	backend := &slowBackend{MockBackend: test.NewMockBackend(), writing: make(chan struct{}), delay: 50 * time.Millisecond}
+	h := newTestHandler(backend)
+	channel := test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY"})
+
+	receive := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		_, err := h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=123&body=Join&from=%2B250788383383&to=2020"))
+		assert.NoError(t, err)
+		return w
+	}
+
+	// Mista retries the callback while our first write of it is still in progress
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- receive() }()
+	<-backend.writing
+	retried := receive()
+
+	// both are acked but only one message is created
+	assert.Equal(t, 200, (<-first).Code)
+	assert.Equal(t, 200, retried.Code)
+	assert.Equal(t, 1, backend.LenQueuedMsgs())
+
+	// a different message from the same sender is still written
+	w := httptest.NewRecorder()
+	_, err := h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=124&body=Join&from=%2B250788383383&to=2020"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, backend.LenQueuedMsgs())
+}
+
+// receiveStatus posts the passed in status to the handler directly, returning the response and the status written
+func receiveStatus(t *testing.T, h *handler, backend *test.MockBackend, channel courier.Channel, data string) (*httptest.ResponseRecorder, courier.MsgStatus) {
+	w := httptest.NewRecorder()
+	r := newFormRequest(statusURL, data)
+	if strings.HasPrefix(data, "{") || strings.HasPrefix(data, "[") {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	_, err := h.receiveStatus(context.Background(), channel, w, r)
+	require.NoError(t, err)
+
+	status, _ := backend.GetLastMsgStatus()
+	return w, status
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY"})
+
+	// the metadata we sent with the message comes back on its status, as a form value or a JSON object
+	w, status := receiveStatus(t, h, backend, channel, "id=mx123&status=Success&metadata=%7B%22campaign%22%3A%22spring%22%7D")
+	assert.Equal(t, 200, w.Code)
+	require.Len(t, status.Logs(), 1)
+	assert.Equal(t, "Metadata Received", status.Logs()[0].Description)
+	assert.Equal(t, `{"campaign":"spring"}`, status.Logs()[0].Request)
+
+	_, status = receiveStatus(t, h, backend, channel, `{"id":"mx124","status":"Success","metadata":{"campaign":"spring"},"report":{"status":"Success"}}`)
+	require.Len(t, status.Logs(), 1)
+	assert.Equal(t, `{"campaign":"spring"}`, status.Logs()[0].Request)
+
+	// without metadata there's nothing to log
+	_, status = receiveStatus(t, h, backend, channel, "id=mx125&status=Success")
+	assert.Empty(t, status.Logs())
+}
+
+func TestDeliveryReportErrorCodes(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{
+		courier.ConfigAPIKey: "KEY",
+		configErrorCodes:     map[string]interface{}{"2": "sender blocked by recipient", "99": "carrier outage"},
+	})
+
+	tcs := []struct {
+		data   string
+		reason string
+	}{
+		{"id=mx123&status=Failed&error_code=1", "absent subscriber (error code 1)"},
+		{"id=mx123&status=Failed&error_code=2", "sender blocked by recipient (error code 2)"},
+		{"id=mx123&status=Failed&error_code=99", "carrier outage (error code 99)"},
+		{"id=mx123&status=Failed&error_code=42", "unknown error (error code 42)"},
+		{"id=mx123&status=Failed&error_code=42&error_message=no+route", "no route (error code 42)"},
+		{"id=mx123&status=Failed&error_message=no+route", "no route"},
+	}
+
+	for _, tc := range tcs {
+		_, status := receiveStatus(t, h, backend, channel, tc.data)
+		assert.Equal(t, courier.MsgFailed, status.Status())
+		require.Len(t, status.Logs(), 1, "logs mismatch for %s", tc.data)
+		assert.Equal(t, "Message Failed", status.Logs()[0].Description)
+		assert.Equal(t, tc.reason, status.Logs()[0].Error, "reason mismatch for %s", tc.data)
+	}
+}
+
+// sendMsg sends a message with the passed in text from the given channel directly with the handler
+func sendMsg(h *handler, backend *test.MockBackend, channel courier.Channel, text string) (courier.MsgStatus, error) {
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), text, false, nil, "", 0, "")
+	return h.SendMsg(context.Background(), msg)
+}
+
+// newFlakyServer returns a server which drops the connection of its first request after reading it, so that we can't
+// know whether Mista accepted it, and then accepts everything else. The returned func gives the number of requests.
+func newFlakyServer(firstStatus int) (*httptest.Server, func() int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			if firstStatus == 0 {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.WriteHeader(firstStatus)
+			return
+		}
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	return server, func() int32 { return atomic.LoadInt32(&requests) }
+}
+
+func TestSafeRetries(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = 20 * time.Millisecond
+
+	tcs := []struct {
+		label       string
+		firstStatus int
+		config      map[string]interface{}
+		requests    int32
+		status      courier.MsgStatusValue
+		err         bool
+	}{
+		{"dropped request not retried without idempotency key", 0, map[string]interface{}{configMaxRetries: 2}, 1, "", true},
+		{"dropped request retried with idempotency key", 0, map[string]interface{}{configMaxRetries: 2, configIdempotencyKey: true}, 2, courier.MsgWired, false},
+		{"server error retried without idempotency key", 503, map[string]interface{}{configMaxRetries: 2}, 2, courier.MsgWired, false},
+		{"nothing retried without retries", 503, map[string]interface{}{}, 1, "", true},
+		{"negative retries still attempted once", 0, map[string]interface{}{configMaxRetries: -1, configIdempotencyKey: true}, 1, "", true},
+	}
+
+	for _, tc := range tcs {
+		server, requests := newFlakyServer(tc.firstStatus)
+
+		backend := test.NewMockBackend()
+		h := newTestHandler(backend)
+		config := map[string]interface{}{courier.ConfigBaseURL: server.URL}
+		for key, value := range tc.config {
+			config[key] = value
+		}
+
+		start := time.Now()
+		status, err := sendMsg(h, backend, newSendChannel(config), "Simple Message")
+		elapsed := time.Since(start)
+		server.Close()
+
+		assert.Equal(t, tc.requests, requests(), "requests mismatch for %s", tc.label)
+		if tc.err {
+			assert.Error(t, err, "expected error for %s", tc.label)
+		} else {
+			require.NoError(t, err, "unexpected error for %s", tc.label)
+			assert.Equal(t, tc.status, status.Status(), "status mismatch for %s", tc.label)
+		}
+
+		// retries of the same endpoint wait a moment first
+		if tc.requests > 1 {
+			assert.GreaterOrEqual(t, elapsed, retryBackoff, "no backoff for %s", tc.label)
+		}
+	}
+
+	// each retry waits twice as long as the last, up to the maximum
+	assert.Equal(t, 20*time.Millisecond, backoffForRetry(1))
+	assert.Equal(t, 40*time.Millisecond, backoffForRetry(2))
+	assert.Equal(t, 80*time.Millisecond, backoffForRetry(3))
+	assert.Equal(t, maxRetryBackoff, backoffForRetry(100))
+}
+
+// metricsRecorder records the metrics reported by a handler
+type metricsRecorder struct {
+	mutex   sync.Mutex
+	reports []string
+}
+
+func (r *metricsRecorder) gauge(name string, value float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reports = append(r.reports, fmt.Sprintf("%s=%g", name, value))
+}
+
+func (r *metricsRecorder) reported() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.reports...)
+}
+
+func TestSendMetrics(t *testing.T) {
+	received := make(chan struct{})
+	respond := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-respond
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	recorder := &metricsRecorder{}
+	h.metrics.gauge = recorder.gauge
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	sent := make(chan error)
+	go func() {
+		_, err := sendMsg(h, backend, channel, "Simple Message")
+		sent <- err
+	}()
+
+	// while Mista has our request the send is in flight
+	<-received
+	queued := "courier.msg_send_queued_" + channelUUID
+	inFlight := "courier.msg_send_in_flight_" + channelUUID
+	assert.Equal(t, []string{queued + "=1", queued + "=0", inFlight + "=1"}, recorder.reported())
+
+	// and once it's done it no longer is
+	close(respond)
+	assert.Error(t, <-sent)
+	assert.Equal(t, []string{queued + "=1", queued + "=0", inFlight + "=1", inFlight + "=0"}, recorder.reported())
+	assert.Empty(t, h.metrics.levels)
+
+	// attempts and failures are counted, and reported as a total for each interval
+	_, err := sendMsg(h, backend, newSendChannel(map[string]interface{}{courier.ConfigBaseURL: "http://127.0.0.1:1"}), "Simple Message")
+	assert.Error(t, err)
+	h.metrics.flush()
+	reported := recorder.reported()[8:]
+	sort.Strings(reported)
+	assert.Equal(t, []string{"courier.msg_send_attempt_" + channelUUID + "=2", "courier.msg_send_error_transport_" + channelUUID + "=2"}, reported)
+
+	// after which they start again
+	h.metrics.flush()
+	assert.Len(t, recorder.reported(), 10)
+
+	// and each channel is reported separately
+	other := test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56cd", "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY", configInsecure: true, courier.ConfigBaseURL: "http://127.0.0.1:1"})
+	_, err = sendMsg(h, backend, other, "Simple Message")
+	assert.Error(t, err)
+	h.metrics.flush()
+	assert.Contains(t, recorder.reported(), "courier.msg_send_attempt_8eb23e93-5ecb-45ba-b726-3b064e0c56cd=1")
+}
+
+// newRecordingServer returns a server which accepts every send, recording the bodies it was sent
+func newRecordingServer(response string) (*httptest.Server, func() []string) {
+	var mutex sync.Mutex
+	bodies := make([]string, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, string(body))
+		mutex.Unlock()
+		w.Write([]byte(response))
+	}))
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), bodies...)
+	}
+}
+
+// sentMessages returns the message field of each of the passed in JSON send bodies
+func sentMessages(t *testing.T, bodies []string) []string {
+	messages := make([]string, len(bodies))
+	for i, payload := range sentPayloads(t, bodies) {
+		messages[i] = payload.Message
+	}
+	return messages
+}
+
+func TestSegmentPolicies(t *testing.T) {
+	// 11 full multipart segments, one more than we allow by default
+	text := strings.Repeat("a", gsm7MultiSegment*11)
+
+	tcs := []struct {
+		policy string
+		status courier.MsgStatusValue
+		sent   []string
+		logs   []string
+	}{
+		{"", courier.MsgFailed, []string{}, []string{"Message Too Long"}},
+		{segmentPolicyReject, courier.MsgFailed, []string{}, []string{"Message Too Long"}},
+		{segmentPolicyTruncate, courier.MsgWired, []string{text[:gsm7MultiSegment*10]}, []string{"Message Sent"}},
+		{segmentPolicySend, courier.MsgWired, []string{text}, []string{"Message Sent"}},
+	}
+
+	for _, tc := range tcs {
+		server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+
+		backend := test.NewMockBackend()
+		h := newTestHandler(backend)
+		config := map[string]interface{}{courier.ConfigBaseURL: server.URL}
+		if tc.policy != "" {
+			config[configSegmentPolicy] = tc.policy
+		}
+
+		status, err := sendMsg(h, backend, newSendChannel(config), text)
+		server.Close()
+
+		require.NoError(t, err)
+		assert.Equal(t, tc.status, status.Status(), "status mismatch for policy '%s'", tc.policy)
+		assert.Equal(t, tc.sent, sentMessages(t, bodies()), "sent mismatch for policy '%s'", tc.policy)
+		assert.Equal(t, tc.logs, logDescriptions(status.Logs()), "logs mismatch for policy '%s'", tc.policy)
+	}
+
+	// messages can be allowed more segments
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+	backend := test.NewMockBackend()
+	status, err := sendMsg(newTestHandler(backend), backend, newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configMaxSegments: 11}), text)
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Len(t, bodies(), 1)
+}
+
+// logDescriptions returns the descriptions of the passed in channel logs
+func logDescriptions(logs []*courier.ChannelLog) []string {
+	descriptions := make([]string, len(logs))
+	for i, log := range logs {
+		descriptions[i] = log.Description
+	}
+	return descriptions
+}
+
+// sentPayloads returns the passed in JSON send bodies decoded
+func sentPayloads(t *testing.T, bodies []string) []*mtPayload {
+	payloads := make([]*mtPayload, len(bodies))
+	for i, body := range bodies {
+		payloads[i] = &mtPayload{}
+		require.NoError(t, json.Unmarshal([]byte(body), payloads[i]))
+	}
+	return payloads
+}
+
+func TestReferenceFields(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configReferenceFields: []interface{}{"client_ref", "custom", "tag"}})
+
+	// references default to our message UUID, unless the flow gave us one
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "Simple Message", false, nil, "", 0, "")
+	msg.WithMetadata(json.RawMessage(`{"custom":"order-42"}`))
+	_, err := h.SendMsg(context.Background(), msg)
+	require.NoError(t, err)
+
+	payload := sentPayloads(t, bodies())[0]
+	assert.Equal(t, msg.UUID().String(), payload.ClientRef)
+	assert.Equal(t, "order-42", payload.Custom)
+	assert.Equal(t, msg.UUID().String(), payload.Tag)
+
+	// only the fields we know can carry references can be used
+	channel.SetConfig(configReferenceFields, "client_ref,token")
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.EqualError(t, err, "build error: unknown reference field 'token', must be one of 'client_ref', 'custom' or 'tag'")
+}
+
+// receiveMsg posts the passed in message to the handler directly, returning the response and the message written
+func receiveMsg(t *testing.T, h *handler, backend *test.MockBackend, channel courier.Channel, data string) (*httptest.ResponseRecorder, courier.Msg) {
+	backend.ClearQueueMsgs()
+
+	w := httptest.NewRecorder()
+	r := newFormRequest(receiveURL, data)
+	if strings.HasPrefix(data, "{") {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	_, err := h.receiveMessage(context.Background(), channel, w, r)
+	require.NoError(t, err)
+
+	msg, _ := backend.GetLastQueueMsg()
+	return w, msg
+}
+
+// msgMetadataOf returns the decoded metadata of the passed in message
+func msgMetadataOf(t *testing.T, msg courier.Msg) map[string]interface{} {
+	metadata := map[string]interface{}{}
+	if len(msg.Metadata()) > 0 {
+		require.NoError(t, json.Unmarshal(msg.Metadata(), &metadata))
+	}
+	return metadata
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	// the session of an inbound message is recorded in its metadata
+	_, msg := receiveMsg(t, h, backend, channel, "id=123&body=Join&from=%2B250788383383&to=2020&session_id=s1")
+	require.NotNil(t, msg)
+	assert.Equal(t, "s1", msgMetadataOf(t, msg)["session_id"])
+
+	// which flows give back to us on replies so they stay in the same conversation
+	reply := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), msg.URN(), "Welcome", false, nil, "", 0, "")
+	reply.WithMetadata(json.RawMessage(`{"session_id":"s1"}`))
+	_, err := h.SendMsg(context.Background(), reply)
+	require.NoError(t, err)
+	assert.Equal(t, "s1", sentPayloads(t, bodies())[0].SessionID)
+
+	// messages outside of a session have none
+	_, msg = receiveMsg(t, h, backend, channel, "id=124&body=Join&from=%2B250788383383&to=2020")
+	assert.NotContains(t, msgMetadataOf(t, msg), "session_id")
+}
+
+func TestEndpointURLs(t *testing.T) {
+	channel := test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{})
+	assert.Equal(t, "https://api.mista.io/sms", endpointURL(channel, endpointSend, nil))
+	assert.Equal(t, "https://api.mista.io/sms/mx%2F123", endpointURL(channel, endpointStatus, map[string]string{"uid": "mx/123"}))
+	assert.Equal(t, "https://api.mista.io/balance", endpointURL(channel, endpointBalance, nil))
+
+	// regional deployments and resellers have their own base URLs and paths
+	channel = test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{
+		courier.ConfigBaseURL: "https://eu.mista.test/api/",
+		"send_path":           "v2/messages",
+		"status_path":         "/v2/messages/{uid}/status",
+	})
+	assert.Equal(t, "https://eu.mista.test/api/v2/messages", endpointURL(channel, endpointSend, nil))
+	assert.Equal(t, "https://eu.mista.test/api/v2/messages/mx123/status", endpointURL(channel, endpointStatus, map[string]string{"uid": "mx123"}))
+	assert.Equal(t, "https://eu.mista.test/api/balance", endpointURL(channel, endpointBalance, nil))
+}
+
+func TestFetchMsgStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sms/mx123":
+			w.Write([]byte(`{"status":"Success","reference":"10"}`))
+		case "/sms/mx124":
+			w.Write([]byte(`{"id":"mx124","report":{"status":"Failed","error_code":"1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	status, err := h.FetchMsgStatus(context.Background(), channel, "mx123")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgID(10), status.ID())
+	assert.Equal(t, courier.MsgDelivered, status.Status())
+
+	status, err = h.FetchMsgStatus(context.Background(), channel, "mx124")
+	require.NoError(t, err)
+	assert.Equal(t, "mx124", status.ExternalID())
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, []string{"Message Failed"}, logDescriptions(status.Logs()))
+	assert.Len(t, backend.MsgStatuses(), 2)
+
+	_, err = h.FetchMsgStatus(context.Background(), channel, "mx125")
+	assert.EqualError(t, err, "error fetching message status: request failed with status code: 404")
+
+	// our API key is never sent anywhere insecure
+	channel = test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY", courier.ConfigBaseURL: server.URL})
+	_, err = h.FetchMsgStatus(context.Background(), channel, "mx123")
+	assert.EqualError(t, err, fmt.Sprintf("error fetching message status: invalid send URL '%s/sms/mx123': scheme must be https", server.URL))
+}
+
+func TestExpiredStatuses(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := test.NewMockChannel(channelUUID, "MX", "2020", "RW", map[string]interface{}{courier.ConfigAPIKey: "KEY"})
+
+	// expired messages fail with their own reason
+	_, status := receiveStatus(t, h, backend, channel, "id=mx123&status=Expired")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	require.Len(t, status.Logs(), 1)
+	assert.Equal(t, "Message Expired", status.Logs()[0].Description)
+	assert.Equal(t, "expired before delivery", status.Logs()[0].Error)
+
+	// unless the account allows them to be sent again, in which case they're errored so they're retried
+	channel.SetConfig(configRetryExpired, true)
+	_, status = receiveStatus(t, h, backend, channel, "id=mx123&status=Expired")
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, []string{"Message Expired"}, logDescriptions(status.Logs()))
+
+	// other failures are unaffected
+	_, status = receiveStatus(t, h, backend, channel, "id=mx123&status=Failed")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Empty(t, status.Logs())
+}
+
+func TestModeration(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configProhibitedPatterns: []interface{}{`\bcasino\b`}})
+
+	// prohibited content is failed without ever reaching Mista
+	status, err := sendMsg(h, backend, channel, "Visit our CASINO tonight")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	require.Len(t, status.Logs(), 1)
+	assert.Equal(t, "Message Moderated", status.Logs()[0].Description)
+	assert.Equal(t, `message contains prohibited content matching '\bcasino\b'`, status.Logs()[0].Error)
+	assert.Empty(t, bodies())
+
+	// anything else is sent
+	status, err = sendMsg(h, backend, channel, "Your appointment is tomorrow")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Len(t, bodies(), 1)
+
+	// deployments can plug in their own moderators
+	h.moderators = append(h.moderators, func(channel courier.Channel, text string) error {
+		if strings.Contains(text, "loan") {
+			return errors.New("lending offers aren't allowed")
+		}
+		return nil
+	})
+	status, err = sendMsg(h, backend, channel, "Get a loan today")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, "lending offers aren't allowed", status.Logs()[0].Error)
+	assert.Len(t, bodies(), 1)
+}
+
+// newTruncatingServer returns a server which responds with the passed in status but closes the connection before
+// sending all of the body it promised
+func newTruncatingServer(statusLine string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		buf.WriteString(statusLine + "\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"uid\":")
+		buf.Flush()
+		conn.Close()
+	}))
+}
+
+func TestBodyReadErrors(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// Mista accepted the message even though we couldn't read what it said, so it's wired without a UID
+	server := newTruncatingServer("HTTP/1.1 200 OK")
+	defer server.Close()
+	status, err := sendMsg(h, backend, newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configMaxRetries: 2}), "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "", status.ExternalID())
+	assert.Equal(t, []string{"Message Send Error"}, logDescriptions(status.Logs()))
+
+	// whereas if it didn't accept it, it's an error like any other
+	server = newTruncatingServer("HTTP/1.1 500 Internal Server Error")
+	defer server.Close()
+	_, err = sendMsg(h, backend, newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL}), "Simple Message")
+	assert.Error(t, err)
+}
+
+func TestSendErrorPhases(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	recorder := &metricsRecorder{}
+	h.metrics.gauge = recorder.gauge
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(401) }))
+	defer rejecting.Close()
+	garbled, _ := newRecordingServer(`not json`)
+	defer garbled.Close()
+
+	tcs := []struct {
+		config map[string]interface{}
+		phase  string
+	}{
+		{map[string]interface{}{courier.ConfigBaseURL: rejecting.URL, configReferenceFields: "token"}, sendPhaseBuild},
+		{map[string]interface{}{courier.ConfigBaseURL: rejecting.URL}, sendPhaseTransport},
+	}
+
+	for _, tc := range tcs {
+		_, err := sendMsg(h, backend, newSendChannel(tc.config), "Simple Message")
+
+		var sendErr *sendError
+		require.True(t, errors.As(err, &sendErr), "expected send error for phase %s", tc.phase)
+		assert.Equal(t, tc.phase, sendErr.phase)
+		h.metrics.flush()
+		assert.Contains(t, recorder.reported(), fmt.Sprintf("courier.msg_send_error_%s_%s=1", tc.phase, channelUUID))
+	}
+
+	// Mista accepted the message if we couldn't parse its response, so that's logged rather than returned
+	status, err := sendMsg(h, backend, newSendChannel(map[string]interface{}{courier.ConfigBaseURL: garbled.URL}), "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Contains(t, logDescriptions(status.Logs()), "Response Parse Error")
+	h.metrics.flush()
+	assert.Contains(t, recorder.reported(), "courier.msg_send_error_parse_"+channelUUID+"=1")
+}
+
+func TestTransportSettings(t *testing.T) {
+	h := newTestHandler(test.NewMockBackend())
+
+	// by default idle connections are kept for 90 seconds and connections live forever
+	channel := newSendChannel(map[string]interface{}{})
+	config, err := transportConfigForChannel(channel)
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, config.idleConnTimeout)
+	assert.Equal(t, time.Duration(0), config.maxConnLifetime)
+	assert.Equal(t, 90*time.Second, config.newTransport().IdleConnTimeout)
+
+	// channels reuse their client until their settings change
+	client, err := h.clientForChannel(channel)
+	require.NoError(t, err)
+	again, _ := h.clientForChannel(channel)
+	assert.True(t, client == again)
+
+	channel.SetConfig(configIdleConnTimeout, 30)
+	channel.SetConfig(configMaxConnLifetime, 1)
+	changed, _ := h.clientForChannel(channel)
+	assert.False(t, client == changed)
+	assert.Equal(t, 30*time.Second, changed.(*sendClient).config.idleConnTimeout)
+
+	// and once a connection has outlived its lifetime, the client swaps in a new transport
+	server, _ := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	sc := changed.(*sendClient)
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := sc.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	original := sc.client
+
+	sc.created = time.Now().Add(-2 * time.Second)
+	resp, err = sc.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.False(t, original == sc.client)
+}
+
+func TestWhitespaceNormalization(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	data := "body=+%0A+JOIN++now%09+&from=%2B250788383383&to=2020"
+
+	// bodies are trimmed by default
+	channel := newSendChannel(map[string]interface{}{})
+	_, msg := receiveMsg(t, h, backend, channel, "id=1&"+data)
+	assert.Equal(t, "JOIN  now", msg.Text())
+
+	// with collapsing on, runs of whitespace inside the body become single spaces as well
+	channel.SetConfig(configCollapseWhitespace, true)
+	_, msg = receiveMsg(t, h, backend, channel, "id=2&"+data)
+	assert.Equal(t, "JOIN now", msg.Text())
+
+	// and with neither, the body is left as Mista sent it
+	channel.SetConfig(configCollapseWhitespace, false)
+	channel.SetConfig(configTrimWhitespace, false)
+	_, msg = receiveMsg(t, h, backend, channel, "id=3&"+data)
+	assert.Equal(t, " \n JOIN  now\t ", msg.Text())
+}
+
+func TestLowBalanceAlerts(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// without a threshold we never alert
+	channel := newSendChannel(map[string]interface{}{})
+	assert.Nil(t, h.checkBalance(channel, 1))
+
+	// with one, we alert once when the balance drops below it
+	channel.SetConfig(configLowBalanceThreshold, 10)
+	assert.Nil(t, h.checkBalance(channel, 25))
+	alert := h.checkBalance(channel, 5)
+	require.NotNil(t, alert)
+	assert.Equal(t, "Low Balance", alert.Description)
+	assert.Nil(t, h.checkBalance(channel, 4))
+
+	// and again only once it's been topped up and drops again
+	assert.Nil(t, h.checkBalance(channel, 50))
+	assert.NotNil(t, h.checkBalance(channel, 9.5))
+
+	// balances reported on sends are checked the same way
+	assert.Nil(t, h.checkBalance(channel, 50))
+	server, _ := newRecordingServer(`{"uid":"mx123","balance":2.5}`)
+	defer server.Close()
+	sendChannel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configLowBalanceThreshold: "10"})
+	status, err := sendMsg(h, backend, sendChannel, "Simple Message")
+	require.NoError(t, err)
+	assert.Contains(t, logDescriptions(status.Logs()), "Low Balance")
+
+	// as are those we fetch, with alerts written as channel logs
+	balanceServer, _ := newRecordingServer(`{"balance":150}`)
+	defer balanceServer.Close()
+	sendChannel.SetConfig(courier.ConfigBaseURL, balanceServer.URL)
+	balance, err := h.FetchBalance(context.Background(), sendChannel)
+	require.NoError(t, err)
+	assert.Equal(t, 150.0, balance)
+	assert.Empty(t, backend.ChannelLogs())
+
+	lowServer, _ := newRecordingServer(`{"balance":3}`)
+	defer lowServer.Close()
+	sendChannel.SetConfig(courier.ConfigBaseURL, lowServer.URL)
+	balance, err = h.FetchBalance(context.Background(), sendChannel)
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, balance)
+	assert.Equal(t, []string{"Low Balance"}, logDescriptions(backend.ChannelLogs()))
+	assert.Contains(t, backend.ChannelLogs()[0].Error, "account balance 3.00 is below the alert threshold of 10.00")
+}
+
+func TestBalanceChecks(t *testing.T) {
+	defer func(interval time.Duration) { balanceCheckInterval = interval }(balanceCheckInterval)
+	balanceCheckInterval = 10 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/balance") {
+			w.Write([]byte(`{"balance":3}`))
+			return
+		}
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// channels without a threshold aren't checked
+	_, err := sendMsg(h, backend, newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL}), "Simple Message")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, backend.ChannelLogs())
+
+	// but those with one have their balance checked periodically once they've sent, alerting once when it's low
+	_, err = sendMsg(h, backend, newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configLowBalanceThreshold: 10}), "Simple Message")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(backend.ChannelLogs()) > 0 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"Low Balance"}, logDescriptions(backend.ChannelLogs()))
+}
+
+func TestInboundMediaTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.Header().Set("Content-Type", "image/jpeg; charset=binary")
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// media is inspected with clients from our factory, so it gets each channel's transport settings, though as our
+	// media host is local we have to let those connect to it
+	var configs []*transportConfig
+	h.newClient = func(config *transportConfig) httpClient {
+		configs = append(configs, config)
+		local := *config
+		local.publicOnly = false
+		return defaultClientFactory(&local)
+	}
+	channel := newSendChannel(map[string]interface{}{configTLSMinVersion: "1.2"})
+
+	// media without an extension has its type looked up from its host
+	_, msg := receiveMsg(t, h, backend, channel, "id=1&body=Photo&from=%2B250788383383&to=2020&media="+url.QueryEscape(server.URL+"/media/123"))
+	assert.Equal(t, []string{"image/jpeg:" + server.URL + "/media/123"}, msg.Attachments())
+	require.Len(t, configs, 1)
+	assert.Equal(t, mediaRequestTimeout, configs[0].timeout)
+	assert.Equal(t, uint16(tls.VersionTLS12), configs[0].tlsMinVersion)
+	assert.True(t, configs[0].publicOnly)
+
+	// media with an extension or an explicit type doesn't need looking up
+	_, msg = receiveMsg(t, h, backend, channel, "id=2&body=Photo&from=%2B250788383383&to=2020&media=https%3A%2F%2Fexample.com%2Fa.png")
+	assert.Equal(t, []string{"image/png:https://example.com/a.png"}, msg.Attachments())
+	_, msg = receiveMsg(t, h, backend, channel, "id=3&body=Photo&from=%2B250788383383&to=2020&media_type=audio%2Fogg&media="+url.QueryEscape(server.URL+"/media/456"))
+	assert.Equal(t, []string{"audio/ogg:" + server.URL + "/media/456"}, msg.Attachments())
+
+	// and media can't be inspected with invalid transport settings, but that doesn't stop us accepting it
+	channel.SetConfig(configTLSMinVersion, "0.9")
+	_, msg = receiveMsg(t, h, backend, channel, "id=4&body=Photo&from=%2B250788383383&to=2020&media="+url.QueryEscape(server.URL+"/media/789"))
+	assert.Equal(t, []string{server.URL + "/media/789"}, msg.Attachments())
+	_, msg = receiveMsg(t, h, backend, channel, "id=5&body=Photo&from=%2B250788383383&to=2020&media=https%3A%2F%2Fexample.com%2Fa.png")
+	assert.Equal(t, []string{"image/png:https://example.com/a.png"}, msg.Attachments())
+	assert.Len(t, configs, 1)
+}
+
+func TestSplitMessages(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configSplitMessages: true, configMaxParts: 2})
+
+	// by default parts are a single segment long, which for unicode is much shorter
+	status, err := sendMsg(h, backend, channel, strings.Repeat("a", 200))
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{strings.Repeat("a", 160), strings.Repeat("a", 40)}, sentMessages(t, bodies()))
+
+	status, err = sendMsg(h, backend, channel, strings.Repeat("ب", 100))
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{strings.Repeat("ب", 70), strings.Repeat("ب", 30)}, sentMessages(t, bodies()[2:]))
+
+	// messages which need more parts than we allow aren't sent at all
+	status, err = sendMsg(h, backend, channel, strings.Repeat("a", 500))
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, []string{"Message Too Long"}, logDescriptions(status.Logs()))
+	assert.Len(t, bodies(), 4)
+}
+
+func TestPartialSends(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte(`{"uid":"mx1"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configSplitMessages: true})
+
+	// our first part went out so we can't retry the message without sending it again, instead it's failed with a
+	// record of what was sent
+	status, err := sendMsg(h, backend, channel, strings.Repeat("a", 400))
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, "mx1", status.ExternalID())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	logs := status.Logs()
+	require.Equal(t, "Partial Send", logs[len(logs)-1].Description)
+	assert.Contains(t, logs[len(logs)-1].Error, "part 2 of 3 failed after 1 were sent with UIDs [mx1]")
+
+	// whereas if nothing went out we can just try again
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.Error(t, err)
+}
+
+func TestTagsAndLabels(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configTag: "campaign", configLabel: "alerts"})
+
+	// by default messages are tagged and labelled as configured on the channel
+	_, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	payload := sentPayloads(t, bodies())[0]
+	assert.Equal(t, "campaign", payload.Tag)
+	assert.Equal(t, "alerts", payload.Label)
+
+	// unless the flow gave us its own
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(11), urns.URN("tel:+250788383383"), "Simple Message", false, nil, "", 0, "")
+	msg.WithMetadata(json.RawMessage(`{"tag":"onboarding","label":"welcome"}`))
+	_, err = h.SendMsg(context.Background(), msg)
+	require.NoError(t, err)
+	payload = sentPayloads(t, bodies())[1]
+	assert.Equal(t, "onboarding", payload.Tag)
+	assert.Equal(t, "welcome", payload.Label)
+
+	// and a tag carrying our reference isn't overwritten
+	channel.SetConfig(configReferenceFields, "tag")
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	payload = sentPayloads(t, bodies())[2]
+	assert.NotEqual(t, "campaign", payload.Tag)
+	assert.Equal(t, "alerts", payload.Label)
+}
+
+func TestChannelVerification(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+
+		switch r.URL.Path {
+		case "/verify":
+			w.Write([]byte(`{"verification_id":"v123"}`))
+		case "/verify/v123/confirm":
+			if strings.Contains(string(body), `"1234"`) {
+				w.Write([]byte(`{"verified":true}`))
+			} else {
+				w.WriteHeader(422)
+				w.Write([]byte(`{"error":"incorrect code"}`))
+			}
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	h := newTestHandler(test.NewMockBackend())
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	// Mista sends a code to the channel's own number
+	verificationID, err := h.SendVerificationCode(context.Background(), channel)
+	require.NoError(t, err)
+	assert.Equal(t, "v123", verificationID)
+	assert.Equal(t, `POST /verify {"phone_number":"2020"}`, requests[0])
+
+	// which is either correct or it isn't
+	verified, err := h.VerifyCode(context.Background(), channel, verificationID, "1234")
+	require.NoError(t, err)
+	assert.True(t, verified)
+	assert.Equal(t, `POST /verify/v123/confirm {"code":"1234"}`, requests[1])
+
+	verified, err = h.VerifyCode(context.Background(), channel, verificationID, "9999")
+	require.NoError(t, err)
+	assert.False(t, verified)
+
+	// but anything else going wrong is an error
+	_, err = h.VerifyCode(context.Background(), channel, "v999", "1234")
+	assert.Error(t, err)
+}
+
+func TestStatusBatches(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// statuses we can't understand are skipped without failing the rest of the batch
+	w, _ := receiveStatus(t, h, backend, channel, `[{"id":"mx1","status":"Success","reference":"10"},{"id":"mx2","status":"Lost"}]`)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "Status Update Accepted")
+	require.Len(t, backend.MsgStatuses(), 1)
+	assert.Equal(t, courier.MsgID(10), backend.MsgStatuses()[0].ID())
+	assert.Equal(t, courier.MsgDelivered, backend.MsgStatuses()[0].Status())
+
+	// but if none of them can be written the batch is an error
+	w = httptest.NewRecorder()
+	r := newFormRequest(statusURL, `[{"id":"mx3","status":"Lost"},{"status":"Success"}]`)
+	r.Header.Set("Content-Type", "application/json")
+	h.receiveStatus(context.Background(), channel, w, r)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "no statuses written: item 0: unknown status 'Lost'")
+	assert.Contains(t, w.Body.String(), "item 1: field 'id' is required")
+	assert.Len(t, backend.MsgStatuses(), 1)
+}
+
+func TestBlockedRecipients(t *testing.T) {
+	var rejection atomic.Value
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(400)
+		w.Write([]byte(rejection.Load().(string)))
+	}))
+	defer server.Close()
+
+	tcs := []struct {
+		rejection  string
+		suppressed bool
+	}{
+		{`{"error":"recipient has blocked this sender"}`, true},
+		{`{"error":"number is on the DND registry"}`, true},
+		{`{"error":"subscriber opted out"}`, true},
+		{`{"error":"sender ID blocked for this destination"}`, false},
+		{`{"error":"request blocked by rate limiter"}`, false},
+	}
+
+	for _, tc := range tcs {
+		backend := test.NewMockBackend()
+		h := newTestHandler(backend)
+		channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configSuppressBlocked: true})
+		rejection.Store(tc.rejection)
+		atomic.StoreInt32(&requests, 0)
+
+		status, err := sendMsg(h, backend, channel, "Simple Message")
+		if tc.suppressed {
+			require.NoError(t, err, "unexpected error for %s", tc.rejection)
+			assert.Equal(t, courier.MsgFailed, status.Status())
+			assert.Contains(t, logDescriptions(status.Logs()), "Recipient Blocked")
+
+			// and we don't try that recipient again until the suppression expires
+			status, err = sendMsg(h, backend, channel, "Simple Message")
+			require.NoError(t, err)
+			assert.Equal(t, courier.MsgFailed, status.Status())
+			assert.Equal(t, []string{"Recipient Suppressed"}, logDescriptions(status.Logs()))
+			assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+		} else {
+			assert.Error(t, err, "expected error for %s", tc.rejection)
+			_, err = sendMsg(h, backend, channel, "Simple Message")
+			assert.Error(t, err)
+			assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "expected no suppression for %s", tc.rejection)
+		}
+	}
+}
+
+func TestDuplicateUIDs(t *testing.T) {
+	server, _ := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	// the first message given a UID is fine, as is the same message being given it again
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.NotContains(t, logDescriptions(status.Logs()), "Duplicate UID")
+	status, err = sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.NotContains(t, logDescriptions(status.Logs()), "Duplicate UID")
+
+	// but a different message getting it is flagged, though it's still sent
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(11), urns.URN("tel:+250788383383"), "Another Message", false, nil, "", 0, "")
+	status, err = h.SendMsg(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "mx123", status.ExternalID())
+	assert.Contains(t, logDescriptions(status.Logs()), "Duplicate UID")
+
+	// UIDs are only remembered up to the size of the cache
+	cache := newUIDCache(2)
+	assert.Equal(t, courier.NilMsgID, cache.record(channel, "a", courier.NewMsgID(1), 1, 1))
+	assert.Equal(t, courier.NilMsgID, cache.record(channel, "b", courier.NewMsgID(2), 1, 1))
+	assert.Equal(t, courier.NewMsgID(1), cache.record(channel, "a", courier.NewMsgID(3), 1, 1))
+	assert.Equal(t, courier.NilMsgID, cache.record(channel, "c", courier.NewMsgID(3), 1, 1))
+	assert.Equal(t, courier.NilMsgID, cache.record(channel, "a", courier.NewMsgID(4), 1, 1))
+}
+
+func TestPriorityKeywords(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{configPriorityKeywords: "help,urgent,msaada,помощь"})
+
+	tcs := []struct {
+		body string
+		high bool
+	}{
+		{"HELP me please", true},
+		{"this is urgent!", true},
+		{"nahitaji msaada", true},
+		{"нужна помощь", true},
+		{"helpful tips", false},
+		{"помощью", false},
+		{"Hello there", false},
+	}
+
+	for i, tc := range tcs {
+		_, msg := receiveMsg(t, h, backend, channel, fmt.Sprintf("id=%d&from=%%2B250788383383&to=2020&body=%s", i, url.QueryEscape(tc.body)))
+		if tc.high {
+			assert.Equal(t, priorityHigh, msgMetadataOf(t, msg)["priority"], "expected high priority for '%s'", tc.body)
+		} else {
+			assert.Nil(t, msgMetadataOf(t, msg)["priority"], "expected normal priority for '%s'", tc.body)
+		}
+	}
+}
+
+func TestPriorityTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configPriorityTimeouts: map[string]interface{}{"high": "50ms", "bulk": 5}})
+
+	// normal priority messages get the default timeout, which is plenty
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+
+	// while high priority messages have to go out quickly or not at all
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(11), urns.URN("tel:+250788383383"), "Urgent Message", true, nil, "", 0, "")
+	_, err = h.SendMsg(context.Background(), msg)
+	assert.Error(t, err)
+
+	// and priorities can also be given to us in metadata
+	msg = backend.NewOutgoingMsg(channel, courier.NewMsgID(12), urns.URN("tel:+250788383383"), "Bulk Message", false, nil, "", 0, "")
+	msg.WithMetadata(json.RawMessage(`{"priority":"bulk"}`))
+	metadata, err := parseMsgMetadata(msg)
+	require.NoError(t, err)
+	request, err := h.buildSendRequest(msg, metadata, "Bearer KEY", "2020", "+250788383383", 0, "Bulk Message", nil, "plain")
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, request.timeout)
+}
+
+func TestOriginCountry(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	_, msg := receiveMsg(t, h, backend, channel, "id=1&body=Hello&from=%2B250788383383&to=2020")
+	assert.Equal(t, "RW", msgMetadataOf(t, msg)["origin_country"])
+
+	_, msg = receiveMsg(t, h, backend, channel, "id=2&body=Hello&from=%2B254712345678&to=2020")
+	assert.Equal(t, "KE", msgMetadataOf(t, msg)["origin_country"])
+
+	assert.Equal(t, "", originCountry(urns.URN("tel:+999123")))
+}
+
+func TestRelaySends(t *testing.T) {
+	var headers http.Header
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		headers = r.Header.Clone()
+		mutex.Unlock()
+		w.Write([]byte(`{"uid":12345}`))
+	}))
+	defer server.Close()
+	recorder, bodies := newRecordingServer(`{}`)
+	defer recorder.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{configRelayURL: server.URL})
+
+	// relays are given the message as is to send on to Mista, and can pass back the UID it was given
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "12345", status.ExternalID())
+	assert.Equal(t, "", headers.Get("Authorization"))
+
+	channel.SetConfig(configRelayURL, recorder.URL)
+	status, err = sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, "", status.ExternalID())
+
+	payload := &relayPayload{}
+	require.NoError(t, json.Unmarshal([]byte(bodies()[0]), payload))
+	assert.Equal(t, courier.NewMsgID(10), payload.ID)
+	assert.Equal(t, channelUUID, payload.ChannelUUID)
+	assert.Equal(t, "2020", payload.From)
+	assert.Equal(t, "tel:+250788383383", payload.URN)
+	assert.Equal(t, "+250788383383", payload.To)
+	assert.Equal(t, "Simple Message", payload.Text)
+
+	// relays have to be secure like anywhere else we send
+	channel.SetConfig(configInsecure, false)
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.Error(t, err)
+}
+
+func TestStatusVersions(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// version 1 statuses are flat form values
+	_, status := receiveStatus(t, h, backend, channel, "id=mx1&status=Failed&reference=10&error_code=3")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, courier.NewMsgID(10), status.ID())
+	assert.Contains(t, status.Logs()[0].Error, "invalid number (error code 3)")
+
+	// version 2 statuses are JSON with the delivery report nested
+	_, status = receiveStatus(t, h, backend, channel, `{"id":"mx2","reference":"11","report":{"status":"Failed","error_code":3,"error_message":"no such number"}}`)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, courier.NewMsgID(11), status.ID())
+	assert.Contains(t, status.Logs()[0].Error, "no such number (error code 3)")
+
+	_, status = receiveStatus(t, h, backend, channel, `{"id":"mx3","report":{"status":"Success","delivered_to":"network"}}`)
+	assert.Equal(t, courier.MsgSent, status.Status())
+	assert.Equal(t, "mx3", status.ExternalID())
+
+	// and channels on version 2 can have them detected without a report
+	channel.SetConfig(configAPIVersion, apiVersionV2)
+	_, status = receiveStatus(t, h, backend, channel, `{"id":"mx4","status":"Success","reference":"12"}`)
+	assert.Equal(t, courier.MsgDelivered, status.Status())
+	assert.Equal(t, courier.NewMsgID(12), status.ID())
+}
+
+func TestSandboxRestrictions(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(403)
+		w.Write([]byte(`{"error":"Sandbox accounts can only send to verified numbers"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configMaxRetries: 3})
+
+	// retrying won't help until the number is verified, so the message is failed straight away
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Contains(t, logDescriptions(status.Logs()), "Sandbox Recipient Not Verified")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestPrefixRoutes(t *testing.T) {
+	uk, ukBodies := newRecordingServer(`{"uid":"uk1"}`)
+	defer uk.Close()
+	us, usBodies := newRecordingServer(`{"uid":"us1"}`)
+	defer us.Close()
+	fallback, fallbackBodies := newRecordingServer(`{"uid":"mx1"}`)
+	defer fallback.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{
+		courier.ConfigSendURL: fallback.URL,
+		configPrefixRoutes:    map[string]interface{}{"+44": uk.URL, "1": us.URL, "+4420": "https://london.example.com"},
+	})
+
+	send := func(urn string) string {
+		msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN(urn), "Simple Message", false, nil, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status.ExternalID()
+	}
+
+	assert.Equal(t, "uk1", send("tel:+447700900123"))
+	assert.Equal(t, "us1", send("tel:+12025550123"))
+	assert.Equal(t, "mx1", send("tel:+250788383383"))
+	assert.Len(t, ukBodies(), 1)
+	assert.Len(t, usBodies(), 1)
+	assert.Len(t, fallbackBodies(), 1)
+
+	// the longest matching prefix wins
+	assert.Equal(t, "https://london.example.com", routeForRecipient(stringMapConfigForKey(channel, configPrefixRoutes), "+442079460000"))
+	assert.Equal(t, uk.URL, routeForRecipient(stringMapConfigForKey(channel, configPrefixRoutes), "+447700900123"))
+	assert.Equal(t, "", routeForRecipient(stringMapConfigForKey(channel, configPrefixRoutes), "+250788383383"))
+}
+
+func TestSenderURNs(t *testing.T) {
+	h := newTestHandler(test.NewMockBackend())
+
+	// by default senders are phone numbers, local ones being parsed for the channel's country
+	channel := newSendChannel(map[string]interface{}{})
+	urn, err := h.senderURN(channel, "", "0788383383")
+	require.NoError(t, err)
+	assert.Equal(t, urns.URN("tel:+250788383383"), urn)
+
+	_, err = h.senderURN(channel, "", "not a number")
+	assert.Error(t, err)
+
+	// but channels can treat them as opaque identifiers
+	channel.SetConfig(configURNScheme, urns.ExternalScheme)
+	urn, err = h.senderURN(channel, "", "device-42")
+	require.NoError(t, err)
+	assert.Equal(t, urns.URN("ext:device-42"), urn)
+
+	// and only schemes we have a builder for can be used
+	channel.SetConfig(configURNScheme, "telegram")
+	_, err = h.senderURN(channel, "", "12345")
+	assert.EqualError(t, err, "unknown URN scheme 'telegram', must be one of 'ext', 'tel', 'whatsapp'")
+
+	h.urnBuilders = map[string]urnBuilder{"telegram": func(channel courier.Channel, sender string) (urns.URN, error) {
+		return urns.NewURNFromParts("telegram", sender, "", "")
+	}}
+	urn, err = h.senderURN(channel, "", "12345")
+	require.NoError(t, err)
+	assert.Equal(t, urns.URN("telegram:12345"), urn)
+}
+
+func TestAckHeaders(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{configAckHeaders: map[string]interface{}{"X-Mista-Ack": "courier", "X-Ignored": 5}})
+
+	// acknowledgements of both messages and statuses carry our configured headers
+	w, _ := receiveMsg(t, h, backend, channel, "id=1&body=Hello&from=%2B250788383383&to=2020")
+	assert.Equal(t, "courier", w.Header().Get("X-Mista-Ack"))
+	assert.Equal(t, "", w.Header().Get("X-Ignored"))
+
+	w, _ = receiveStatus(t, h, backend, channel, "id=mx1&status=Success&reference=10")
+	assert.Equal(t, "courier", w.Header().Get("X-Mista-Ack"))
+
+	// as do errors so Mista can tell who rejected its request
+	w = httptest.NewRecorder()
+	h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=2&from=%2B250788383383&to=2020"))
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "courier", w.Header().Get("X-Mista-Ack"))
+}
+
+func TestJSONStatusValues(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// JSON statuses can give them as numbers or booleans rather than names
+	_, status := receiveStatus(t, h, backend, channel, `[{"id":"mx1","status":1,"reference":"10"}]`)
+	assert.Equal(t, courier.MsgDelivered, status.Status())
+	_, status = receiveStatus(t, h, backend, channel, `[{"id":"mx2","status":false,"reference":"10"}]`)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	_, status = receiveStatus(t, h, backend, channel, `[{"id":"mx3","status":"TRUE","reference":"10"}]`)
+	assert.Equal(t, courier.MsgDelivered, status.Status())
+}
+
+func TestPlaceholders(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configSubstitutePlaceholders: true, configProhibitedPatterns: "casino"})
+
+	send := func(text string) (courier.MsgStatus, error) {
+		msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), text, false, nil, "", 0, "")
+		msg.WithMetadata(json.RawMessage(`{"attributes":{"name":"Ada","age":36,"venue":"the casino"}}`))
+		return h.SendMsg(context.Background(), msg)
+	}
+
+	// placeholders are replaced by the matching attributes, unmatched ones being left by default
+	_, err := send("Hi {{name}}, you're {{ age }} and your code is {{code}}")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Hi Ada, you're 36 and your code is {{code}}"}, sentMessages(t, bodies()))
+
+	// or blanked if the channel prefers
+	channel.SetConfig(configUnmatchedPlaceholders, unmatchedPlaceholdersBlank)
+	_, err = send("Hi {{name}}, your code is {{code}}")
+	require.NoError(t, err)
+	assert.Equal(t, "Hi Ada, your code is ", sentMessages(t, bodies())[1])
+
+	channel.SetConfig(configUnmatchedPlaceholders, "drop")
+	_, err = send("Hi {{name}}")
+	assert.EqualError(t, err, "build error: unknown unmatched placeholders mode 'drop', must be one of 'leave' or 'blank'")
+
+	// moderation applies to what we'd actually send, placeholders and all
+	channel.SetConfig(configUnmatchedPlaceholders, unmatchedPlaceholdersLeave)
+	status, err := send("See you at {{venue}}")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, []string{"Message Moderated"}, logDescriptions(status.Logs()))
+	assert.Len(t, bodies(), 2)
+
+	// as well as any transliteration
+	channel.SetConfig(configTransliterate, true)
+	status, err = send("Come to the casîno")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Len(t, bodies(), 2)
+}
+
+func TestSendThrottling(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configSendRate: 10, configSendBurst: 3})
+
+	// a burst goes out straight away
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := sendMsg(h, backend, channel, "Simple Message")
+		require.NoError(t, err)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// after which we're held to the sustained rate
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := sendMsg(h, backend, channel, "Simple Message")
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(150*time.Millisecond))
+	assert.Len(t, bodies(), 5)
+
+	// and sends which can't wait for their turn give it up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "Simple Message", false, nil, "", 0, "")
+	_, err := h.SendMsg(ctx, msg)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, bodies(), 5)
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1, 2)
+
+	// full buckets allow a burst of their capacity
+	assert.Equal(t, time.Duration(0), bucket.reserve())
+	assert.Equal(t, time.Duration(0), bucket.reserve())
+
+	// after which callers have to wait, unless they don't use their token
+	assert.InDelta(t, float64(time.Second), float64(bucket.reserve()), float64(10*time.Millisecond))
+	bucket.cancel()
+	taken, delay := bucket.take()
+	assert.False(t, taken)
+	assert.InDelta(t, float64(time.Second), float64(delay), float64(10*time.Millisecond))
+}
+
+func TestAggregatePartStatuses(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{configAggregateParts: true})
+
+	// a message is only delivered once all its parts are
+	_, status := receiveStatus(t, h, backend, channel, "id=mx1&status=Success&reference=10&part=1&parts=2")
+	assert.Equal(t, courier.MsgSent, status.Status())
+	_, status = receiveStatus(t, h, backend, channel, "id=mx2&status=Success&reference=10&part=2&parts=2")
+	assert.Equal(t, courier.MsgDelivered, status.Status())
+
+	// and fails if any part does, even if it's later reported as delivered
+	_, status = receiveStatus(t, h, backend, channel, "id=mx3&status=Failed&reference=11&part=1&parts=2")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	_, status = receiveStatus(t, h, backend, channel, "id=mx3&status=Success&reference=11&part=1&parts=2")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	_, status = receiveStatus(t, h, backend, channel, "id=mx4&status=Success&reference=11&part=2&parts=2")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+
+	// single part messages are reported as they are
+	_, status = receiveStatus(t, h, backend, channel, "id=mx5&status=Success&reference=12&part=1&parts=1")
+	assert.Equal(t, courier.MsgDelivered, status.Status())
+}
+
+func TestPreviewMessage(t *testing.T) {
+	channel := newSendChannel(map[string]interface{}{})
+
+	preview, err := PreviewMessage(strings.Repeat("a", 161), channel)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", preview.Encoding)
+	assert.Equal(t, 2, preview.Segments)
+	assert.Nil(t, preview.Cost)
+
+	// unicode messages take more segments, and with a cost per segment we can estimate what they'll cost
+	channel.SetConfig(configSegmentCost, 0.02)
+	preview, err = PreviewMessage(strings.Repeat("ب", 71), channel)
+	require.NoError(t, err)
+	assert.Equal(t, "unicode", preview.Encoding)
+	assert.Equal(t, 2, preview.Segments)
+	require.NotNil(t, preview.Cost)
+	assert.InDelta(t, 0.04, *preview.Cost, 0.0001)
+
+	// and previews show any transliteration that would happen
+	channel.SetConfig(configTransliterate, true)
+	preview, err = PreviewMessage("naïve", channel)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", preview.Encoding)
+	assert.Equal(t, "naive", preview.Text)
+}
+
+func TestMMSFallbackText(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configMMSFallbackText: "See your photo at example.com"})
+
+	send := func(text string, attachments []string, metadata string) *mtPayload {
+		msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), text, false, nil, "", 0, "")
+		for _, a := range attachments {
+			msg = msg.WithAttachment(a)
+		}
+		if metadata != "" {
+			msg.WithMetadata(json.RawMessage(metadata))
+		}
+		_, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+
+		payloads := sentPayloads(t, bodies())
+		return payloads[len(payloads)-1]
+	}
+
+	// messages with attachments are sent as MMS with the channel's fallback text
+	payload := send("Your photo", []string{"image/jpeg:https://example.com/photo.jpg"}, "")
+	assert.Equal(t, []string{"https://example.com/photo.jpg"}, payload.Media)
+	assert.Equal(t, "See your photo at example.com", payload.Fallback)
+
+	// unless the flow gave us its own
+	payload = send("Your photo", []string{"image/jpeg:https://example.com/photo.jpg"}, `{"attributes":{"mms_fallback_text":"Photo at example.com/p/1"}}`)
+	assert.Equal(t, "Photo at example.com/p/1", payload.Fallback)
+
+	// and messages without attachments don't need fallback text
+	payload = send("Just text", nil, "")
+	assert.Empty(t, payload.Media)
+	assert.Equal(t, "", payload.Fallback)
+}
+
+func TestUnencodableCharacters(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	// emoji are sent as surrogate pairs so can be encoded fine
+	status, err := sendMsg(h, backend, channel, "Well done 👍🏽")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.NotContains(t, logDescriptions(status.Logs()), "Message Not Encodable")
+
+	// but invalid UTF-8 and noncharacters can't be, which by default we warn about
+	status, err = sendMsg(h, backend, channel, "Bad \xff byte")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Contains(t, logDescriptions(status.Logs()), "Message Not Encodable")
+	assert.Len(t, bodies(), 2)
+
+	// or if the channel prefers, fail without sending
+	channel.SetConfig(configUnencodablePolicy, unencodablePolicyFail)
+	status, err = sendMsg(h, backend, channel, "Not a character \uFFFE at all")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, "message contains characters which can't be encoded: '\\ufffe' (U+FFFE)", status.Logs()[0].Error)
+	assert.Len(t, bodies(), 2)
+
+	assert.Equal(t, []string{`"\xff"`, `'\U0010ffff' (U+10FFFF)`, `'\ufdd0' (U+FDD0)`}, unencodableChars("a\xffb\U0010FFFF\uFDD0😀"))
+}
+
+// newTLSServer returns a TLS server which accepts every send but only supports up to the passed in TLS version, along
+// with a client factory for clients which trust it
+func newTLSServer(maxVersion uint16) (*httptest.Server, clientFactory) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	server.TLS = &tls.Config{MaxVersion: maxVersion}
+	server.StartTLS()
+
+	trusted := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return server, func(config *transportConfig) httpClient {
+		transport := config.newTransport()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = trusted
+		return &http.Client{Transport: transport}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	server, factory := newTLSServer(tls.VersionTLS12)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	h.newClient = factory
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configInsecure: false})
+
+	// by default we connect with whatever Go allows
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+
+	// servers which support our minimum are fine
+	channel.SetConfig(configTLSMinVersion, "1.2")
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+
+	// but we won't connect to those which don't
+	channel.SetConfig(configTLSMinVersion, "1.3")
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.Error(t, err)
+
+	// and only real TLS versions can be configured
+	channel.SetConfig(configTLSMinVersion, "2.0")
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.EqualError(t, err, "build error: invalid TLS minimum version '2.0', must be one of '1.0', '1.1', '1.2' or '1.3'")
+}
+
+func TestInboundLanguage(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// without detection on we don't record languages
+	channel := newSendChannel(map[string]interface{}{})
+	_, msg := receiveMsg(t, h, backend, channel, "id=1&body=Hello+how+are+you&from=%2B250788383383&to=2020&language=eng")
+	assert.Nil(t, msgMetadataOf(t, msg)["language"])
+
+	// with it on we prefer the language Mista gives us
+	channel.SetConfig(configDetectLanguage, true)
+	_, msg = receiveMsg(t, h, backend, channel, "id=2&body=Hello+how+are+you&from=%2B250788383383&to=2020&language=fra")
+	assert.Equal(t, "fra", msgMetadataOf(t, msg)["language"])
+
+	// falling back to detecting it ourselves
+	_, msg = receiveMsg(t, h, backend, channel, "id=3&body=Hello+how+are+you&from=%2B250788383383&to=2020")
+	assert.Equal(t, "eng", msgMetadataOf(t, msg)["language"])
+	_, msg = receiveMsg(t, h, backend, channel, "id=4&body=Murakoze+cyane&from=%2B250788383383&to=2020")
+	assert.Equal(t, "kin", msgMetadataOf(t, msg)["language"])
+	_, msg = receiveMsg(t, h, backend, channel, "id=5&body="+url.QueryEscape("مرحبا كيف حالك")+"&from=%2B250788383383&to=2020")
+	assert.Equal(t, "ara", msgMetadataOf(t, msg)["language"])
+
+	// unless it isn't clear
+	_, msg = receiveMsg(t, h, backend, channel, "id=6&body=OK&from=%2B250788383383&to=2020")
+	assert.Nil(t, msgMetadataOf(t, msg)["language"])
+}
+
+func TestLogSampling(t *testing.T) {
+	server, _ := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configLogSampleRate: 3})
+
+	// only one in every three successful sends keeps its logs
+	kept := make([]int, 0)
+	for i := 0; i < 6; i++ {
+		status, err := sendMsg(h, backend, channel, "Simple Message")
+		require.NoError(t, err)
+		assert.Equal(t, courier.MsgWired, status.Status())
+		assert.Equal(t, "mx123", status.ExternalID())
+		kept = append(kept, len(status.Logs()))
+	}
+	assert.Equal(t, []int{1, 0, 0, 1, 0, 0}, kept)
+
+	// but anything going wrong is always logged
+	channel.SetConfig(configUnencodablePolicy, unencodablePolicyWarn)
+	for i := 0; i < 3; i++ {
+		status, err := sendMsg(h, backend, channel, "Bad \xff byte")
+		require.NoError(t, err)
+		assert.Contains(t, logDescriptions(status.Logs()), "Message Not Encodable")
+	}
+}
+
+func TestCancelMsg(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if strings.Contains(r.URL.Path, "mx999") {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	// cancelled messages are failed
+	status, err := h.CancelMsg(context.Background(), channel, "mx123")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, "mx123", status.ExternalID())
+	assert.Equal(t, []string{"Message Cancelled"}, logDescriptions(status.Logs()))
+	assert.Len(t, backend.MsgStatuses(), 1)
+
+	// unless Mista couldn't cancel them
+	_, err = h.CancelMsg(context.Background(), channel, "mx999")
+	assert.Error(t, err)
+	assert.Len(t, backend.MsgStatuses(), 1)
+
+	// and we can only cancel messages Mista gave a UID
+	_, err = h.CancelMsg(context.Background(), channel, "")
+	assert.EqualError(t, err, "can't cancel message without a UID")
+	assert.Equal(t, []string{"POST /sms/mx123/cancel", "POST /sms/mx999/cancel"}, requests)
+}
+
+func TestSendDeduplication(t *testing.T) {
+	var failing atomic.Value
+	failing.Store(false)
+	var mutex sync.Mutex
+	bodies := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load().(bool) {
+			w.WriteHeader(500)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, string(body))
+		mutex.Unlock()
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configDedupKey: dedupKeyRecipientBody})
+
+	send := func(id int64, urn string, text string) (courier.MsgStatus, error) {
+		msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(id), urns.URN(urn), text, false, nil, "", 0, "")
+		return h.SendMsg(context.Background(), msg)
+	}
+
+	// the same text to the same recipient is only sent once, even as a different message
+	_, err := send(10, "tel:+250788383383", "Your code is 1234")
+	require.NoError(t, err)
+	status, err := send(11, "tel:+250788383383", "Your code is 1234")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, []string{"Duplicate Message"}, logDescriptions(status.Logs()))
+
+	// whereas different text or recipients are sent
+	_, err = send(12, "tel:+250788383384", "Your code is 1234")
+	require.NoError(t, err)
+	_, err = send(13, "tel:+250788383383", "Your code is 5678")
+	require.NoError(t, err)
+	assert.Len(t, bodies, 3)
+
+	// and sends which didn't go through can be tried again
+	failing.Store(true)
+	_, err = send(14, "tel:+250788383383", "Hello")
+	assert.Error(t, err)
+	failing.Store(false)
+	status, err = send(14, "tel:+250788383383", "Hello")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Len(t, bodies, 4)
+
+	// by default we leave deduplication to courier
+	channel.SetConfig(configDedupKey, dedupKeyID)
+	status, err = send(15, "tel:+250788383383", "Hello")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+}
+
+func TestFallbackSender(t *testing.T) {
+	var mutex sync.Mutex
+	var senders, keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := &mtPayload{}
+		json.NewDecoder(r.Body).Decode(payload)
+		mutex.Lock()
+		senders = append(senders, payload.SenderID)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		mutex.Unlock()
+
+		if payload.SenderID == "2020" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"Sender ID not allowed for this destination"}`))
+			return
+		}
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configIdempotencyKey: true})
+
+	// without a fallback sender, a rejected sender is just an error
+	_, err := sendMsg(h, backend, channel, "Simple Message")
+	assert.Error(t, err)
+
+	// with one we try again from it, which is a new send as far as Mista is concerned
+	channel.SetConfig(configFallbackSender, "INFO")
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "mx123", status.ExternalID())
+	assert.Contains(t, logDescriptions(status.Logs()), "Sender Rejected")
+
+	assert.Equal(t, []string{"2020", "2020", "INFO"}, senders)
+	assert.Equal(t, keys[0], keys[1])
+	assert.NotEqual(t, keys[1], keys[2])
+	assert.Equal(t, defaultIdempotencyKey(channel, courier.NewMsgID(10), "INFO", 0), keys[2])
+}
+
+func TestAttachmentLimit(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{configMaxAttachments: 2, configMaxAttachmentSize: 0})
+	media := url.QueryEscape("https://example.com/1.jpg,https://example.com/2.png,https://example.com/3.gif")
+
+	// by default the extras are dropped and the message is still delivered
+	_, msg := receiveMsg(t, h, backend, channel, "id=1&body=Photos&from=%2B250788383383&to=2020&media="+media)
+	assert.Equal(t, []string{"image/jpeg:https://example.com/1.jpg", "image/png:https://example.com/2.png"}, msg.Attachments())
+
+	// messages within the limit keep everything
+	_, msg = receiveMsg(t, h, backend, channel, "id=2&body=Photos&from=%2B250788383383&to=2020&media="+url.QueryEscape("https://example.com/1.jpg"))
+	assert.Len(t, msg.Attachments(), 1)
+
+	// or the whole message can be rejected
+	channel.SetConfig(configAttachmentLimitPolicy, attachmentLimitPolicyReject)
+	backend.ClearQueueMsgs()
+	w := httptest.NewRecorder()
+	h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=3&body=Photos&from=%2B250788383383&to=2020&media="+media))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "message has 3 attachments, more than the maximum of 2")
+	assert.Equal(t, 0, backend.LenQueuedMsgs())
+}
+
+func TestInvalidSenderLogs(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	receive := func(data string) int {
+		w := httptest.NewRecorder()
+		h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, data))
+		return w.Code
+	}
+
+	// by default we only reject messages from senders we can't parse
+	assert.Equal(t, 400, receive("id=1&body=Hello&from=%2B25-not-a-number&to=2020"))
+	assert.Empty(t, backend.ChannelLogs())
+
+	// but can log what they were to help diagnose where they're coming from
+	channel.SetConfig(configLogInvalidSenders, true)
+	assert.Equal(t, 400, receive("id=2&body=Hello&from=%2B25-not-a-number&to=2020"))
+	require.Len(t, backend.ChannelLogs(), 1)
+	assert.Equal(t, "Invalid Sender", backend.ChannelLogs()[0].Description)
+	assert.Contains(t, backend.ChannelLogs()[0].Error, "unable to create URN for sender '+25-not-a-number'")
+
+	// valid senders are never logged
+	assert.Equal(t, 200, receive("id=3&body=Hello&from=%2B250788383383&to=2020"))
+	assert.Len(t, backend.ChannelLogs(), 1)
+}
+
+func TestJSONPointers(t *testing.T) {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"a":{"b/c":[10,{"d~e":"found"}]}}`), &doc))
+
+	value, found := resolvePointer(doc, jsonPathPointer("a.b/c.1.d~e"))
+	assert.True(t, found)
+	assert.Equal(t, "found", value)
+
+	value, found = resolvePointer(doc, "/a/b~1c/0")
+	assert.True(t, found)
+	assert.Equal(t, 10.0, value)
+
+	_, found = resolvePointer(doc, "/a/b~1c/2")
+	assert.False(t, found)
+	_, found = resolvePointer(doc, "/a/x")
+	assert.False(t, found)
+	_, found = resolvePointer(doc, "a")
+	assert.False(t, found)
+}
+
+func TestCompressedSends(t *testing.T) {
+	var mutex sync.Mutex
+	var encodings, messages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = reader
+		}
+		payload := &mtPayload{}
+		require.NoError(t, json.NewDecoder(body).Decode(payload))
+
+		mutex.Lock()
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		messages = append(messages, payload.Message)
+		mutex.Unlock()
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configCompressRequests: true, configCompressMinSize: 500})
+
+	// small requests aren't worth compressing, large ones are
+	long := strings.Repeat("Hello there ", 50)
+	for _, text := range []string{"Simple Message", long} {
+		_, err := sendMsg(h, backend, channel, text)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"", "gzip"}, encodings)
+	assert.Equal(t, []string{"Simple Message", long}, messages)
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	channel := newSendChannel(map[string]interface{}{})
+	other := test.NewMockChannel("f4b2a7c1-2d3e-4f5a-8b9c-0d1e2f3a4b5c", "MX", "2020", "RW", map[string]interface{}{})
+
+	// keys are the same every time for the same send
+	key := defaultIdempotencyKey(channel, courier.NewMsgID(10), "2020", 0)
+	assert.Len(t, key, 32)
+	assert.Equal(t, key, defaultIdempotencyKey(channel, courier.NewMsgID(10), "2020", 0))
+
+	// and differ for each part, sender, message and channel
+	assert.NotEqual(t, key, defaultIdempotencyKey(channel, courier.NewMsgID(10), "2020", 1))
+	assert.NotEqual(t, key, defaultIdempotencyKey(channel, courier.NewMsgID(10), "INFO", 0))
+	assert.NotEqual(t, key, defaultIdempotencyKey(channel, courier.NewMsgID(11), "2020", 0))
+	assert.NotEqual(t, key, defaultIdempotencyKey(other, courier.NewMsgID(10), "2020", 0))
+
+	// deployments can replace how they're generated
+	var keys []string
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	defer recorder.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	h.idempotencyKey = func(channel courier.Channel, msgID courier.MsgID, sender string, part int) string {
+		return fmt.Sprintf("%s-%s-%d", msgID, sender, part)
+	}
+	sendChannel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: recorder.URL, configIdempotencyKey: true})
+	_, err := sendMsg(h, backend, sendChannel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10-2020-0"}, keys)
+
+	// and channels which don't want them don't get them
+	sendChannel.SetConfig(configIdempotencyKey, false)
+	_, err = sendMsg(h, backend, sendChannel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10-2020-0", ""}, keys)
+}
+
+func TestDerivedConfigCache(t *testing.T) {
+	channel := test.NewMockChannel("9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d", "MX", "2020", "RW", map[string]interface{}{
+		"words": []interface{}{"stop", "end"},
+		"name":  "courier",
+	})
+
+	cache := &configCache{}
+	parses := 0
+	parse := func(config interface{}) interface{} {
+		parses++
+		return fmt.Sprint(config)
+	}
+
+	// unchanged config is only parsed once
+	assert.Equal(t, "[stop end]", cache.get(channel, "words", "test", parse))
+	assert.Equal(t, "[stop end]", cache.get(channel, "words", "test", parse))
+	assert.Equal(t, "courier", cache.get(channel, "name", "test", parse))
+	assert.Equal(t, "courier", cache.get(channel, "name", "test", parse))
+	assert.Equal(t, 2, parses)
+
+	// but is parsed again as soon as it changes
+	channel.SetConfig("words", []interface{}{"stop"})
+	channel.SetConfig("name", "mista")
+	assert.Equal(t, "[stop]", cache.get(channel, "words", "test", parse))
+	assert.Equal(t, "mista", cache.get(channel, "name", "test", parse))
+	assert.Equal(t, 4, parses)
+
+	// including to a list of the same length, or by being edited in place
+	channel.SetConfig("words", []interface{}{"quit"})
+	assert.Equal(t, "[quit]", cache.get(channel, "words", "test", parse))
+	words := []interface{}{"halt"}
+	channel.SetConfig("words", words)
+	assert.Equal(t, "[halt]", cache.get(channel, "words", "test", parse))
+	words[0] = "cancel"
+	assert.Equal(t, "[cancel]", cache.get(channel, "words", "test", parse))
+	assert.Equal(t, 7, parses)
+
+	// as is config which goes missing
+	channel.SetConfig("name", nil)
+	assert.Equal(t, "<nil>", cache.get(channel, "name", "test", parse))
+	assert.Equal(t, 8, parses)
+}
+
+func TestAutoAck(t *testing.T) {
+	acks := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		acks <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// channels which don't ask for acks don't get them
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+	_, msg := receiveMsg(t, h, backend, channel, "id=ack1&body=Join&from=%2B250788383383&to=2020")
+	require.NotNil(t, msg)
+
+	// those which do get one for each message received
+	channel.SetConfig(configAutoAck, true)
+	_, msg = receiveMsg(t, h, backend, channel, "id=ack2&body=Join&from=%2B250788383383&to=2020")
+	require.NotNil(t, msg)
+
+	select {
+	case ack := <-acks:
+		assert.Equal(t, `POST /sms/ack2/ack {"status":"received"}`, strings.TrimSpace(ack))
+	case <-time.After(time.Second):
+		assert.Fail(t, "message wasn't acknowledged")
+	}
+	assert.Len(t, acks, 0)
+}
+
+func TestUrgentInbound(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	tcs := []struct {
+		data     string
+		metadata map[string]interface{}
+	}{
+		{"id=urg1&body=Help&from=%2B250788383383&to=2020&urgent=true", map[string]interface{}{"urgent": true, "priority": priorityHigh}},
+		{"id=urg2&body=Help&from=%2B250788383383&to=2020&priority=urgent", map[string]interface{}{"urgent": true, "priority": priorityHigh}},
+		{"id=urg3&body=Help&from=%2B250788383383&to=2020&urgent=false", map[string]interface{}{}},
+		{"id=urg4&body=Help&from=%2B250788383383&to=2020", map[string]interface{}{}},
+	}
+	for _, tc := range tcs {
+		_, msg := receiveMsg(t, h, backend, channel, tc.data)
+		require.NotNil(t, msg, tc.data)
+
+		metadata := msgMetadataOf(t, msg)
+		for key, value := range tc.metadata {
+			assert.Equal(t, value, metadata[key], tc.data)
+		}
+		if len(tc.metadata) == 0 {
+			assert.NotContains(t, metadata, "urgent", tc.data)
+			assert.NotContains(t, metadata, "priority", tc.data)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	acks := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acks <- r.URL.Path
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configAutoAck: true})
+	receive := func(data string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		_, err := h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, data))
+		return w, err
+	}
+
+	// normally a failed write is an error so that Mista retries it
+	backend.SetErrorOnQueue(true)
+	_, err := receive("id=dl1&body=Join&from=%2B250788383383&to=2020")
+	assert.Error(t, err)
+	assert.Equal(t, 0, backend.LenQueuedMsgs())
+
+	// but channels can have us ack it and buffer it instead
+	channel.SetConfig(configDeadLetter, true)
+	w, err := receive("id=dl1&body=Join&from=%2B250788383383&to=2020")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 0, backend.LenQueuedMsgs())
+
+	// it isn't seen or acked until it's actually written, so a retry from Mista is buffered rather than dropped
+	w, err = receive("id=dl1&body=Join&from=%2B250788383383&to=2020")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, w.Code)
+	assert.Len(t, h.deadLetters.msgs, 2)
+
+	// failed replays keep messages buffered
+	written, err := h.ReplayDeadLetters(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 0, written)
+	assert.Len(t, h.deadLetters.msgs, 2)
+	assert.Len(t, acks, 0)
+
+	// once the backend is back they're replayed in the background until the server stops
+	backend.SetErrorOnQueue(false)
+	s := courier.NewServer(courier.NewConfig(), backend)
+	h.startDeadLetterReplay(s, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool { return backend.LenQueuedMsgs() > 0 }, time.Second, 10*time.Millisecond)
+	close(s.StopChan())
+	s.WaitGroup().Wait()
+
+	// with the retried copy recognized as already written
+	assert.Equal(t, 1, backend.LenQueuedMsgs())
+	assert.Len(t, h.deadLetters.msgs, 0)
+	assert.Equal(t, "/sms/dl1/ack", <-acks)
+
+	// and now it's been written, further retries are recognized
+	_, msg := receiveMsg(t, h, backend, channel, "id=dl1&body=Join&from=%2B250788383383&to=2020")
+	assert.Nil(t, msg)
+}
+
+// logOf returns the log with the passed in description from the given logs, nil if there isn't one
+func logOf(logs []*courier.ChannelLog, description string) *courier.ChannelLog {
+	for _, log := range logs {
+		if log.Description == description {
+			return log
+		}
+	}
+	return nil
+}
+
+func TestDeliveryLatency(t *testing.T) {
+	server, _ := newRecordingServer(`{"uid":"mxlat1"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	_, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	// interim statuses don't have a latency
+	_, status := receiveStatus(t, h, backend, channel, "id=mxlat1&status=DeliveredToNetwork")
+	assert.Nil(t, logOf(status.Logs(), "Delivery Latency"))
+
+	// final ones do, whether they are tied back by UID or by reference
+	_, status = receiveStatus(t, h, backend, channel, "id=mxlat1&status=Success")
+	latency := logOf(status.Logs(), "Delivery Latency")
+	require.NotNil(t, latency)
+	assert.GreaterOrEqual(t, int64(latency.Elapsed), int64(20*time.Millisecond))
+	assert.Contains(t, latency.Response, "final status 'D' after")
+
+	_, status = receiveStatus(t, h, backend, channel, "id=mxlat2&status=Failed&reference=10")
+	assert.NotNil(t, logOf(status.Logs(), "Delivery Latency"))
+
+	// and we don't know when messages we didn't send were sent
+	_, status = receiveStatus(t, h, backend, channel, "id=mxother&status=Success")
+	assert.Nil(t, logOf(status.Logs(), "Delivery Latency"))
+}
+
+func TestSplitStrategies(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configSplitMessages: true, courier.ConfigMaxLength: 10})
+
+	// by default we avoid breaking words across parts
+	_, err := sendMsg(h, backend, channel, "hello there world")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello", "there", "world"}, sentMessages(t, bodies()))
+
+	// but channels can split at exactly the maximum length
+	channel.SetConfig(configSplitStrategy, splitStrategyHard)
+	_, err = sendMsg(h, backend, channel, "hello there world")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello ther", "e world"}, sentMessages(t, bodies()[3:]))
+
+	// and anything else is a configuration error
+	channel.SetConfig(configSplitStrategy, "sentence")
+	_, err = sendMsg(h, backend, channel, "hello there world")
+	assert.EqualError(t, err, "build error: unknown split strategy 'sentence', must be one of 'word' or 'hard'")
+	assert.Len(t, bodies(), 5)
+
+	assert.Equal(t, []string{"abc"}, splitHard("abc", 0))
+	assert.Equal(t, []string{"ab", "c"}, splitHard("abc", 2))
+}
+
+// newSubscriptionsServer returns a server which acts as Mista's webhook subscriptions API, starting with the passed in
+// subscriptions, and a func returning the requests it has received
+func newSubscriptionsServer(existing []*subscription) (*httptest.Server, func() []string) {
+	var mutex sync.Mutex
+	requests := make([]string, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(map[string]interface{}{"subscriptions": existing})
+			return
+		}
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func TestReconcileSubscriptions(t *testing.T) {
+	callback := "https://localhost/c/mx/" + channelUUID
+
+	// missing subscriptions are created and those pointed elsewhere updated, others being left alone
+	server, requests := newSubscriptionsServer([]*subscription{
+		{ID: "1", Event: "inbound", URL: callback + "/receive"},
+		{ID: "2", Event: "dlr", URL: "https://old.example.com/status"},
+		{ID: "3", Event: "clicks", URL: "https://other.example.com/clicks"},
+	})
+	defer server.Close()
+
+	h := newTestHandler(test.NewMockBackend())
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+
+	require.NoError(t, h.ReconcileSubscriptions(context.Background(), channel))
+	assert.ElementsMatch(t, []string{
+		`GET /webhooks`,
+		`PUT /webhooks/2 {"event":"dlr","url":"` + callback + `/status"}`,
+		`POST /webhooks {"event":"ussd","url":"` + callback + `/ussd"}`,
+	}, requests())
+
+	// reconciling subscriptions which are already right changes nothing
+	server, requests = newSubscriptionsServer([]*subscription{
+		{ID: "1", Event: "inbound", URL: callback + "/receive"},
+		{ID: "2", Event: "dlr", URL: callback + "/status"},
+		{ID: "4", Event: "ussd", URL: callback + "/ussd"},
+	})
+	defer server.Close()
+
+	channel.SetConfig(courier.ConfigBaseURL, server.URL)
+	require.NoError(t, h.ReconcileSubscriptions(context.Background(), channel))
+	assert.Equal(t, []string{`GET /webhooks`}, requests())
+
+	// and errors are returned
+	channel.SetConfig(courier.ConfigBaseURL, "http://localhost:1")
+	assert.Error(t, h.ReconcileSubscriptions(context.Background(), channel))
+}
+
+func TestManagedSubscriptions(t *testing.T) {
+	server, requests := newSubscriptionsServer(nil)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	receive := h.withSubscriptions(h.receiveMessage)
+	reconciles := func() int {
+		count := 0
+		for _, request := range requests() {
+			if request == "GET /webhooks" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// channels which don't have us manage their subscriptions are left alone
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+	_, err := receive(context.Background(), channel, httptest.NewRecorder(), newFormRequest(receiveURL, "id=sub1&body=Join&from=%2B250788383383&to=2020"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, reconciles())
+
+	// those which do have them reconciled in the background when first used, failures not holding anything up
+	channel.SetConfig(configManageSubscriptions, true)
+	channel.SetConfig(courier.ConfigBaseURL, "http://localhost:1")
+	w := httptest.NewRecorder()
+	_, err = receive(context.Background(), channel, w, newFormRequest(receiveURL, "id=sub2&body=Join&from=%2B250788383383&to=2020"))
+	require.NoError(t, err)
+	assert.Equal(t, 200, w.Code)
+
+	// and being tried again the next time the channel is used, sends included
+	assert.Eventually(t, func() bool {
+		_, reconciled := h.reconciled.Load(channelUUID)
+		return !reconciled
+	}, time.Second, 10*time.Millisecond)
+
+	channel.SetConfig(courier.ConfigBaseURL, server.URL)
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(requests()) == 5 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, reconciles())
+
+	// but once reconciled they aren't again
+	_, err = receive(context.Background(), channel, httptest.NewRecorder(), newFormRequest(receiveURL, "id=sub3&body=Join&from=%2B250788383383&to=2020"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, reconciles())
+}
+
+func TestUCS2HexBodies(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// "Hi 😀" with the emoji as a surrogate pair, flagged as UCS-2 in any of the fields accounts use for it
+	for i, field := range []string{"encoding=ucs2", "coding=8", "charset=UTF-16BE"} {
+		_, msg := receiveMsg(t, h, backend, channel, fmt.Sprintf("id=ucs%d&body=004800690020D83DDE00&from=%%2B250788383383&to=2020&%s", i, field))
+		require.NotNil(t, msg, field)
+		assert.Equal(t, "Hi 😀", msg.Text(), field)
+	}
+
+	// unflagged bodies are left as they are
+	_, msg := receiveMsg(t, h, backend, channel, "id=ucs3&body=004800690020D83DDE00&from=%2B250788383383&to=2020&coding=0")
+	require.NotNil(t, msg)
+	assert.Equal(t, "004800690020D83DDE00", msg.Text())
+
+	// and flagged ones which aren't valid hex are rejected
+	w := httptest.NewRecorder()
+	h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=ucs4&body=D83DDE0&from=%2B250788383383&to=2020&coding=8"))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid UCS-2 hex body")
+}
+
+func TestRetryStatusCodes(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// by default timeouts from Mista aren't retried
+	server, requests := newFlakyServer(http.StatusRequestTimeout)
+	defer server.Close()
+
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configMaxRetries: 1})
+	_, err := sendMsg(h, backend, channel, "Simple Message")
+	assert.EqualError(t, err, "transport error: SMS request failed with status code: 408")
+	assert.Equal(t, int32(1), requests())
+
+	// but channels can have them retried
+	server, requests = newFlakyServer(http.StatusRequestTimeout)
+	defer server.Close()
+
+	channel = newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configMaxRetries: 1, configRetryStatusCodes: []interface{}{"408", "5xx"}})
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "mx123", status.ExternalID())
+	assert.Equal(t, int32(2), requests())
+
+	assert.True(t, isRetryableStatus(defaultRetryStatusCodes, 503))
+	assert.True(t, isRetryableStatus(defaultRetryStatusCodes, 429))
+	assert.False(t, isRetryableStatus(defaultRetryStatusCodes, 400))
+	assert.True(t, isRetryableStatus([]string{"4XX"}, 408))
+}
+
+func TestPartConcurrency(t *testing.T) {
+	var mutex sync.Mutex
+	sent := make([]string, 0)
+	inFlight, maxInFlight := 0, 0
+
+	// each part is given a UID derived from its text, and takes a little while so concurrent parts overlap
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := &mtPayload{}
+		json.NewDecoder(r.Body).Decode(payload)
+
+		mutex.Lock()
+		sent = append(sent, payload.Message)
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		fmt.Fprintf(w, `{"uid":"mx-%s"}`, payload.Message)
+	}))
+	defer server.Close()
+
+	reset := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent, maxInFlight = sent[:0], 0
+	}
+
+	tcs := []struct {
+		concurrency string
+		maxInFlight int
+	}{
+		{partConcurrencySequential, 1},
+		{partConcurrencyConcurrent, 3},
+	}
+	for _, tc := range tcs {
+		reset()
+
+		backend := test.NewMockBackend()
+		h := newTestHandler(backend)
+		channel := newSendChannel(map[string]interface{}{
+			courier.ConfigBaseURL: server.URL, configSplitMessages: true, courier.ConfigMaxLength: 3, configAggregateParts: true,
+			configPartConcurrency: tc.concurrency,
+		})
+
+		status, err := sendMsg(h, backend, channel, "one two six")
+		require.NoError(t, err, tc.concurrency)
+		assert.Equal(t, courier.MsgWired, status.Status(), tc.concurrency)
+		assert.Equal(t, "mx-one", status.ExternalID(), tc.concurrency)
+
+		mutex.Lock()
+		if tc.concurrency == partConcurrencySequential {
+			assert.Equal(t, []string{"one", "two", "six"}, sent)
+		} else {
+			assert.ElementsMatch(t, []string{"one", "two", "six"}, sent)
+		}
+		assert.Equal(t, tc.maxInFlight, maxInFlight, tc.concurrency)
+		mutex.Unlock()
+
+		// every part's UID is tied back to its part of our message, so per-part statuses without a reference combine
+		// into the status of the whole message
+		for j, uid := range []string{"mx-one", "mx-six", "mx-two"} {
+			_, status = receiveStatus(t, h, backend, channel, "id="+uid+"&status=Success")
+			assert.Equal(t, courier.NewMsgID(10), status.ID(), uid)
+
+			if j < 2 {
+				assert.Equal(t, courier.MsgSent, status.Status(), uid)
+			} else {
+				assert.Equal(t, courier.MsgDelivered, status.Status(), uid)
+				assert.NotNil(t, logOf(status.Logs(), "Delivery Latency"), uid)
+			}
+		}
+	}
+
+	// and anything else is a configuration error
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configPartConcurrency: "parallel"})
+	_, err := sendMsg(h, backend, channel, "one two six")
+	assert.EqualError(t, err, "build error: unknown part concurrency 'parallel', must be one of 'sequential' or 'concurrent'")
+}
+
+// logText returns all the text of the passed in logs, so that tests can check what they reveal
+func logText(logs []*courier.ChannelLog) string {
+	var text strings.Builder
+	for _, log := range logs {
+		for _, s := range []string{log.Description, log.URL, log.Request, log.Response, log.Error} {
+			text.WriteString(s + "\n")
+		}
+	}
+	return text.String()
+}
+
+func TestPseudonymizedSenders(t *testing.T) {
+	number := "+250788383383"
+	server, bodies := newRecordingServer(`{"uid":"mx123","recipient":"+250788383383","to":"250788383383"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configPseudonymKey: "sesame", configLogInvalidSenders: true})
+
+	// senders are stored as pseudonyms, always the same one for the same number
+	_, msg := receiveMsg(t, h, backend, channel, "id=ps1&body=Hello&from=%2B250788383383&to=2020")
+	require.NotNil(t, msg)
+	assert.Equal(t, urns.ExternalScheme, msg.URN().Scheme())
+	assert.True(t, strings.HasPrefix(msg.URN().Path(), pseudonymPrefix))
+	assert.NotContains(t, msg.URN().String(), "788383383")
+	assert.Equal(t, "RW", msgMetadataOf(t, msg)["origin_country"])
+
+	_, again := receiveMsg(t, h, backend, channel, "id=ps2&body=Hello&from=%2B250788383383&to=2020")
+	require.NotNil(t, again)
+	assert.Equal(t, msg.URN(), again.URN())
+
+	// senders we can't parse aren't logged even though the channel asks for it
+	w := httptest.NewRecorder()
+	h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=ps3&body=Hello&from=%2B25-788383383-not-a-number&to=2020"))
+	assert.Equal(t, 400, w.Code)
+	assert.NotContains(t, logText(backend.ChannelLogs()), "788383383")
+
+	// replies reach the real number, without it appearing in what we log, even when Mista gives it back to us
+	reply := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), msg.URN(), "Hi there", false, nil, "", 0, "")
+	status, err := h.SendMsg(context.Background(), reply)
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, number, sentPayloads(t, bodies())[0].Recipient)
+	assert.Contains(t, logDescriptions(status.Logs()), "Message Sent")
+	assert.NotContains(t, logText(status.Logs()), "788383383")
+	assert.Contains(t, logText(status.Logs()), msg.URN().Path())
+
+	// as is the case for relayed replies
+	channel.SetConfig(configRelayURL, server.URL+"/relay")
+	status, err = h.SendMsg(context.Background(), reply)
+	require.NoError(t, err)
+	assert.Contains(t, bodies()[1], `"to":"+250788383383"`)
+	assert.Contains(t, logDescriptions(status.Logs()), "Message Sent")
+	assert.NotContains(t, logText(status.Logs()), "788383383")
+
+	// and replies to pseudonyms made with another key can't be sent
+	channel.SetConfig(configPseudonymKey, "other")
+	_, err = h.SendMsg(context.Background(), reply)
+	assert.Error(t, err)
+}
+
+func TestNormalizedUIDs(t *testing.T) {
+	server, _ := newRecordingServer(`{"uid":" MX-abc123 "}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// by default UIDs are used exactly as Mista gives them to us
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, " MX-abc123 ", status.ExternalID())
+
+	// but channels can have padding and prefixes removed, from sends and statuses alike, so that they match
+	channel.SetConfig(configNormalizeUIDs, true)
+	channel.SetConfig(configUIDPrefix, "MX-")
+	status, err = sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", status.ExternalID())
+
+	for _, uid := range []string{"abc123", "MX-abc123", "%20MX-%20abc123%20"} {
+		_, status = receiveStatus(t, h, backend, channel, "id="+uid+"&status=DeliveredToNetwork")
+		assert.Equal(t, courier.NewMsgID(10), status.ID(), uid)
+	}
+
+	// including those for messages we don't remember sending
+	_, status = receiveStatus(t, h, backend, channel, "id=%20MX-xyz789&status=DeliveredToNetwork")
+	assert.Equal(t, "xyz789", status.ExternalID())
+}
+
+func TestFetchQueueStatus(t *testing.T) {
+	h := newTestHandler(test.NewMockBackend())
+	fetch := func(status int, body string) (*QueueStatus, error) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/sms/queue", r.URL.Path)
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+		defer server.Close()
+
+		return h.FetchQueueStatus(context.Background(), newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL}))
+	}
+
+	queue, err := fetch(200, `{"queued":12,"scheduled":3,"oldest_queued_on":"2026-10-14T10:30:00+02:00"}`)
+	require.NoError(t, err)
+	assert.Equal(t, 12, queue.Queued)
+	assert.Equal(t, 3, queue.Scheduled)
+	require.NotNil(t, queue.OldestOn)
+	assert.Equal(t, time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC), *queue.OldestOn)
+
+	// older deployments call queued messages pending
+	queue, err = fetch(200, `{"pending":4}`)
+	require.NoError(t, err)
+	assert.Equal(t, 4, queue.Queued)
+	assert.Nil(t, queue.OldestOn)
+
+	_, err = fetch(200, `{"scheduled":2}`)
+	assert.EqualError(t, err, "queue status response missing queued count")
+
+	_, err = fetch(200, `{"queued":1,"oldest_queued_on":"yesterday"}`)
+	assert.EqualError(t, err, "invalid oldest queued date in queue status: yesterday")
+
+	_, err = fetch(404, `{"error":"not found"}`)
+	assert.EqualError(t, err, "error fetching queue status: queue status not available for this account")
+
+	_, err = fetch(500, `{"error":"oops"}`)
+	assert.Error(t, err)
+}
+
+func TestSoftBounces(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{configSoftBounceCodes: []interface{}{"27"}})
+
+	// soft bounces are errored so that courier requeues them
+	for _, s := range []string{"SoftBounce", "Deferred", "TemporaryFailure"} {
+		_, status := receiveStatus(t, h, backend, channel, "id=mxsb1&status="+s+"&reference=10")
+		assert.Equal(t, courier.MsgErrored, status.Status(), s)
+		assert.Contains(t, logDescriptions(status.Logs()), "Soft Bounce", s)
+	}
+
+	// as are failures with codes the channel knows are temporary, though other failures are final
+	_, status := receiveStatus(t, h, backend, channel, "id=mxsb2&status=Failed&reference=10&error_code=27")
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Contains(t, logDescriptions(status.Logs()), "Soft Bounce")
+
+	_, status = receiveStatus(t, h, backend, channel, "id=mxsb3&status=Failed&reference=10&error_code=3")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.NotContains(t, logDescriptions(status.Logs()), "Soft Bounce")
+
+	// and channels which don't want soft bounces retried can have them failed
+	channel.SetConfig(configFailSoftBounces, true)
+	_, status = receiveStatus(t, h, backend, channel, "id=mxsb4&status=SoftBounce&reference=10")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Contains(t, logDescriptions(status.Logs()), "Soft Bounce")
+}
+
+// mockClient is an HTTP client which answers every request itself rather than making it
+type mockClient struct {
+	requests []*http.Request
+	respond  func(r *http.Request) (*http.Response, error)
+}
+
+func (c *mockClient) Do(r *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, r)
+	return c.respond(r)
+}
+
+func TestMockClients(t *testing.T) {
+	client := &mockClient{}
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	h.newClient = func(config *transportConfig) httpClient { return client }
+
+	// no server is needed to test sends, which go wherever the channel is configured to
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: "https://mista.test"})
+	client.respond = func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"uid":"mock1"}`)), Request: r}, nil
+	}
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "mock1", status.ExternalID())
+	require.Len(t, client.requests, 1)
+	assert.Equal(t, "https://mista.test/sms", client.requests[0].URL.String())
+	assert.Equal(t, "Bearer KEY", client.requests[0].Header.Get("Authorization"))
+
+	// including failures which would be hard to produce from a real server
+	client.respond = func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection reset by peer")
+	}
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "connection reset by peer")
+	assert.Len(t, client.requests, 2)
+}
+
+func TestBufferedStatuses(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// by default buffered messages are sent as far as we're concerned
+	_, status := receiveStatus(t, h, backend, channel, "id=mxbuf1&status=Buffered&reference=10")
+	assert.Equal(t, courier.MsgSent, status.Status())
+
+	// but channels can treat them as only wired until the operator tries delivering them
+	channel.SetConfig(configBufferedStatus, bufferedStatusWired)
+	_, status = receiveStatus(t, h, backend, channel, "id=mxbuf2&status=Buffered&reference=10")
+	assert.Equal(t, courier.MsgWired, status.Status())
+
+	// and anything else is a configuration error
+	channel.SetConfig(configBufferedStatus, "queued")
+	w, _ := receiveStatus(t, h, backend, channel, "id=mxbuf3&status=Buffered&reference=10")
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown buffered status 'queued', must be one of 'sent' or 'wired'")
+}
+
+func TestRequestDLR(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+	send := func(metadata string) bool {
+		msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "Simple Message", false, nil, "", 0, "")
+		if metadata != "" {
+			msg.WithMetadata(json.RawMessage(metadata))
+		}
+		_, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+
+		sent := bodies()
+		return sentPayloads(t, sent[len(sent)-1:])[0].DLR
+	}
+
+	// by default we ask for delivery reports, always including the flag so Mista doesn't apply its own default
+	assert.True(t, send(""))
+	assert.Contains(t, bodies()[0], `"dlr":true`)
+
+	// channels on plans which charge for them can turn them off, and flows can override the channel either way
+	channel.SetConfig(configRequestDLR, false)
+	assert.False(t, send(""))
+	assert.Contains(t, bodies()[1], `"dlr":false`)
+	assert.True(t, send(`{"request_dlr":true}`))
+
+	channel.SetConfig(configRequestDLR, true)
+	assert.False(t, send(`{"request_dlr":false}`))
+}
+
+func TestNumericUIDs(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	// UIDs larger than a float can hold exactly are kept exactly as Mista wrote them
+	for _, response := range []string{`{"uid":"9007199254740993"}`, `{"uid":9007199254740993}`} {
+		server, _ := newRecordingServer(response)
+		channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+		status, err := sendMsg(h, backend, channel, "Simple Message")
+		require.NoError(t, err, response)
+		assert.Equal(t, "9007199254740993", status.ExternalID(), response)
+
+		// including when sent via a relay
+		channel.SetConfig(configRelayURL, server.URL+"/relay")
+		status, err = sendMsg(h, backend, channel, "Simple Message")
+		require.NoError(t, err, response)
+		assert.Equal(t, "9007199254740993", status.ExternalID(), response)
+		server.Close()
+	}
+
+	// and statuses for them match whether their IDs are strings or numbers
+	channel := newSendChannel(map[string]interface{}{})
+	_, status := receiveStatus(t, h, backend, channel, `{"id":"9007199254740995","report":{"status":"Success"}}`)
+	assert.Equal(t, "9007199254740995", status.ExternalID())
+	_, status = receiveStatus(t, h, backend, channel, `{"id":9007199254740997,"report":{"status":"Success"}}`)
+	assert.Equal(t, "9007199254740997", status.ExternalID())
+}
+
+func TestSendDeadlines(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = 5 * time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configMaxRetries: 100})
+
+	// we stop retrying as soon as courier's deadline for the send has passed rather than making every attempt
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "Simple Message", false, nil, "", 0, "")
+	_, err := h.SendMsg(ctx, msg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "deadline exceeded")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Less(t, atomic.LoadInt32(&requests), int32(10))
+}
+
+func TestReceiveThrottling(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{configReceiveRate: 0.5, configReceiveBurst: 2})
+	receive := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		_, err := h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id="+id+"&body=Join&from=%2B250788383383&to=2020"))
+		require.NoError(t, err)
+		return w
+	}
+
+	// a burst of messages is received as normal
+	assert.Equal(t, 200, receive("thr1").Code)
+	assert.Equal(t, 200, receive("thr2").Code)
+	assert.Equal(t, 2, backend.LenQueuedMsgs())
+
+	// but beyond that Mista is told to try again once the rate allows
+	w := receive("thr3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "inbound rate limit exceeded")
+	assert.Equal(t, 2, backend.LenQueuedMsgs())
+	require.Len(t, backend.ChannelLogs(), 1)
+	assert.Equal(t, "Receive Throttled", backend.ChannelLogs()[0].Description)
+
+	// channels without a rate aren't throttled at all
+	channel.SetConfig(configReceiveRate, nil)
+	for _, id := range []string{"thr4", "thr5", "thr6"} {
+		assert.Equal(t, 200, receive(id).Code)
+	}
+	assert.Equal(t, 5, backend.LenQueuedMsgs())
+}
+
+func TestEchoedStatusAcks(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// by default we just acknowledge statuses
+	w, _ := receiveStatus(t, h, backend, channel, "id=mxe1&status=Success&reference=10")
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), `"id":"mxe1"`)
+
+	// but channels can have us echo back which status we processed for each
+	channel.SetConfig(configEchoStatusAcks, true)
+	w, status := receiveStatus(t, h, backend, channel, "id=mxe2&status=Success&reference=10")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, courier.MsgDelivered, status.Status())
+	assert.Contains(t, w.Body.String(), `{"id":"mxe2","status":"D"}`)
+
+	w, _ = receiveStatus(t, h, backend, channel, `[{"id":"mxe3","status":"Success","reference":"10"},{"id":"mxe4","status":"Failed","reference":"11"}]`)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `[{"id":"mxe3","status":"D"},{"id":"mxe4","status":"F"}]`)
+}
+
+func TestWhatsAppSenders(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	tcs := []struct {
+		data string
+		urn  string
+	}{
+		{"id=wa1&body=Hi&from=%2B250788383383&to=2020", "tel:+250788383383"},
+		{"id=wa2&body=Hi&from=%2B250788383383&to=2020&source=whatsapp", "whatsapp:250788383383"},
+		{"id=wa3&body=Hi&from=250788383383&to=2020&source=WA", "whatsapp:250788383383"},
+		{"id=wa4&body=Hi&from=whatsapp%3A250788383383&to=2020", "whatsapp:250788383383"},
+		{"id=wa5&body=Hi&from=%2B250788383383&to=2020&source=sms", "tel:+250788383383"},
+	}
+	for _, tc := range tcs {
+		_, msg := receiveMsg(t, h, backend, channel, tc.data)
+		require.NotNil(t, msg, tc.data)
+		assert.Equal(t, tc.urn, msg.URN().String(), tc.data)
+	}
+}
+
+func TestDuplicateStatuses(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// by default every status is written, even the same one twice
+	receiveStatus(t, h, backend, channel, "id=mxd1&status=Success&reference=10")
+	receiveStatus(t, h, backend, channel, "id=mxd1&status=Success&reference=10")
+	assert.Len(t, backend.MsgStatuses(), 2)
+
+	// but channels can have the same status within a window acknowledged without being written again
+	channel.SetConfig(configStatusDedupWindow, 60)
+	w, _ := receiveStatus(t, h, backend, channel, "id=mxd2&status=Success&reference=10")
+	assert.Equal(t, 200, w.Code)
+	w, _ = receiveStatus(t, h, backend, channel, "id=mxd2&status=Success&reference=10")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "duplicate status, ignored")
+	assert.Len(t, backend.MsgStatuses(), 3)
+
+	// different statuses for the same message are still written, in batches too
+	receiveStatus(t, h, backend, channel, "id=mxd2&status=Failed&reference=10")
+	assert.Len(t, backend.MsgStatuses(), 4)
+
+	receiveStatus(t, h, backend, channel, `[{"id":"mxd2","status":"Failed","reference":"10"},{"id":"mxd3","status":"Success","reference":"11"}]`)
+	assert.Len(t, backend.MsgStatuses(), 5)
+}
+
+func TestBlockedLandlines(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+	send := func(urn string) courier.MsgStatus {
+		msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN(urn), "Simple Message", false, nil, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err, urn)
+		return status
+	}
+
+	// by default we leave it to Mista to work out what can be delivered
+	assert.Equal(t, courier.MsgWired, send("tel:+250252123456").Status())
+	assert.Len(t, bodies(), 1)
+
+	// but channels can fail sends to landlines without trying them
+	channel.SetConfig(configBlockLandlines, true)
+	status := send("tel:+250252123456")
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, []string{"Landline Recipient"}, logDescriptions(status.Logs()))
+	assert.Equal(t, courier.MsgFailed, send("tel:+442079460000").Status())
+	assert.Len(t, bodies(), 1)
+
+	// while mobiles, and numbers which could be either, are still sent to
+	assert.Equal(t, courier.MsgWired, send("tel:+250788383383").Status())
+	assert.Equal(t, courier.MsgWired, send("tel:+447911123456").Status())
+	assert.Equal(t, courier.MsgWired, send("tel:+12025550123").Status())
+	assert.Len(t, bodies(), 4)
+}
+
+func TestEncodingOrder(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+
+	tcs := []struct {
+		order    []interface{}
+		text     string
+		msgType  string
+		sentText string
+	}{
+		{nil, "Hello", "plain", "Hello"},
+		{nil, "Hello ب", "unicode", "Hello ب"},
+		{[]interface{}{"ucs2", "gsm"}, "Hello", "unicode", "Hello"},
+		{[]interface{}{"gsm", "ucs2"}, "naïve", "unicode", "naïve"},
+		{[]interface{}{"gsm"}, "Hello", "plain", "Hello"},
+		{[]interface{}{"ucs2"}, "Hello ب", "unicode", "Hello ب"},
+	}
+	for _, tc := range tcs {
+		channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configEncodingOrder: tc.order})
+		status, err := sendMsg(h, backend, channel, tc.text)
+		require.NoError(t, err, tc.order)
+		assert.Equal(t, courier.MsgWired, status.Status(), tc.order)
+
+		sent := bodies()
+		payload := sentPayloads(t, sent[len(sent)-1:])[0]
+		assert.Equal(t, tc.msgType, payload.Type, tc.order)
+		assert.Equal(t, tc.sentText, payload.Message, tc.order)
+	}
+
+	// transliteration applies when trying GSM7, so can avoid needing unicode at all
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configEncodingOrder: []interface{}{"gsm"}, configTransliterate: true})
+	_, err := sendMsg(h, backend, channel, "naïve")
+	require.NoError(t, err)
+	sent := bodies()
+	assert.Equal(t, "plain", sentPayloads(t, sent[len(sent)-1:])[0].Type)
+
+	// messages which can't be sent with any of the channel's encodings are failed rather than retried
+	channel = newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configEncodingOrder: []interface{}{"gsm"}})
+	status, err := sendMsg(h, backend, channel, "Hello ب")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, []string{"Message Not Encodable"}, logDescriptions(status.Logs()))
+	assert.Contains(t, status.Logs()[0].Error, "message can't be sent using any of the encodings gsm")
+	assert.Len(t, bodies(), len(tcs)+1)
+
+	// though unknown encodings are configuration errors
+	channel = newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configEncodingOrder: []interface{}{"ascii"}})
+	_, err = sendMsg(h, backend, channel, "Hello")
+	assert.EqualError(t, err, "build error: unknown encoding 'ascii' in encoding order, must be one of 'gsm' or 'ucs2'")
+}
+
+func TestSplitAttachments(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123","cost":0.5,"parts":1}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	newMsg := func(channel courier.Channel) courier.Msg {
+		msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "Simple Message", false, nil, "", 0, "")
+		return msg.WithAttachment("image/jpeg:https://example.com/a.jpg").WithAttachment("image/jpeg:https://example.com/b.jpg")
+	}
+
+	// by default all attachments go with the message
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL})
+	_, err := h.SendMsg(context.Background(), newMsg(channel))
+	require.NoError(t, err)
+
+	payloads := sentPayloads(t, bodies())
+	require.Len(t, payloads, 1)
+	assert.Equal(t, []string{"https://example.com/a.jpg", "https://example.com/b.jpg"}, payloads[0].Media)
+
+	// but can be sent one per request, with the text going with the first
+	channel = newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configSplitAttachments: true})
+	status, err := h.SendMsg(context.Background(), newMsg(channel))
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+
+	payloads = sentPayloads(t, bodies()[1:])
+	require.Len(t, payloads, 2)
+	sort.Slice(payloads, func(i, j int) bool { return payloads[i].Media[0] < payloads[j].Media[0] })
+	assert.Equal(t, []string{"https://example.com/a.jpg"}, payloads[0].Media)
+	assert.Equal(t, "Simple Message", payloads[0].Message)
+	assert.Equal(t, []string{"https://example.com/b.jpg"}, payloads[1].Media)
+	assert.Equal(t, "", payloads[1].Message)
+
+	// and what the whole message cost is logged
+	cost := logOf(status.Logs(), "Send Cost")
+	require.NotNil(t, cost)
+	assert.JSONEq(t, `{"cost":1,"parts":2,"requests":2}`, cost.Response)
+}
+
+func TestTLSCipherSuites(t *testing.T) {
+	server, factory := newTLSServer(tls.VersionTLS12)
+	server.TLS.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	h.newClient = factory
+	channel := newSendChannel(map[string]interface{}{courier.ConfigBaseURL: server.URL, configInsecure: false})
+
+	// servers which support one of our cipher suites are fine
+	channel.SetConfig(configTLSCipherSuites, []interface{}{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	status, err := sendMsg(h, backend, channel, "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+
+	// but we won't connect to those which don't
+	channel.SetConfig(configTLSCipherSuites, []interface{}{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.Error(t, err)
+
+	// and suites Go considers insecure can't be configured
+	channel.SetConfig(configTLSCipherSuites, []interface{}{"TLS_RSA_WITH_RC4_128_SHA"})
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.EqualError(t, err, "build error: unsupported TLS cipher suite 'TLS_RSA_WITH_RC4_128_SHA'")
+}
+
+func TestMaxAttachmentSize(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.Header().Set("Content-Type", "image/jpeg")
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Length", "100")
+		case "/large":
+			w.Header().Set("Content-Length", "2000")
+		case "/unknown":
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	h.newClient = func(config *transportConfig) httpClient {
+		local := *config
+		local.publicOnly = false
+		return defaultClientFactory(&local)
+	}
+	media := url.QueryEscape(server.URL+"/small") + "," + url.QueryEscape(server.URL+"/large") + "," + url.QueryEscape(server.URL+"/unknown")
+
+	// without a limit we only ask about media we need the type of
+	channel := newSendChannel(map[string]interface{}{configMaxAttachmentSize: 0})
+	_, msg := receiveMsg(t, h, backend, channel, "id=1&body=Photos&from=%2B250788383383&to=2020&media="+media+",https%3A%2F%2Fexample.com%2Fa.png")
+	assert.Equal(t, []string{"image/jpeg:" + server.URL + "/small", "image/jpeg:" + server.URL + "/large", "image/jpeg:" + server.URL + "/unknown", "image/png:https://example.com/a.png"}, msg.Attachments())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// with one, media over it is skipped but media we can't tell the size of isn't, asking each host about its media
+	// just once
+	channel = newSendChannel(map[string]interface{}{configMaxAttachmentSize: 1000})
+	_, msg = receiveMsg(t, h, backend, channel, "id=2&body=Photos&from=%2B250788383383&to=2020&media="+media)
+	assert.Equal(t, "Photos", msg.Text())
+	assert.Equal(t, []string{"image/jpeg:" + server.URL + "/small", "image/jpeg:" + server.URL + "/unknown"}, msg.Attachments())
+	assert.Equal(t, int32(6), atomic.LoadInt32(&requests))
+
+	// and by default channels have a limit of 10MB
+	huge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(defaultMaxAttachmentSize+1))
+	}))
+	defer huge.Close()
+	_, msg = receiveMsg(t, h, backend, newSendChannel(nil), "id=4&body=Photo&from=%2B250788383383&to=2020&media="+url.QueryEscape(huge.URL+"/huge.jpg"))
+	assert.Empty(t, msg.Attachments())
+	assert.Equal(t, 10*1024*1024, defaultMaxAttachmentSize)
+
+	// and media can't be on hosts which aren't public
+	h = newTestHandler(backend)
+	_, msg = receiveMsg(t, h, backend, newSendChannel(map[string]interface{}{configMaxAttachmentSize: 0}), "id=3&body=Photo&from=%2B250788383383&to=2020&media="+url.QueryEscape(server.URL+"/small"))
+	assert.Equal(t, []string{server.URL + "/small"}, msg.Attachments())
+	assert.Equal(t, int32(6), atomic.LoadInt32(&requests))
+}
+
+func TestEstimateCost(t *testing.T) {
+	channel := newSendChannel(map[string]interface{}{configSegmentRates: map[string]interface{}{"RW": 0.02, "UG": "0.03"}})
+
+	// countries in the rate table are charged their own rate
+	cost, err := EstimateCost(channel, "RW", 3)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.06, cost, 0.0001)
+	cost, err = EstimateCost(channel, " ug ", 2)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.06, cost, 0.0001)
+
+	// others the table's default rate, falling back to the channel's cost per segment
+	_, err = EstimateCost(channel, "KE", 1)
+	assert.EqualError(t, err, "no rate configured for country 'KE'")
+	channel.SetConfig(configSegmentCost, 0.05)
+	cost, err = EstimateCost(channel, "KE", 2)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.1, cost, 0.0001)
+	channel.SetConfig(configSegmentRates, map[string]interface{}{"RW": 0.02, "*": 0.04})
+	cost, err = EstimateCost(channel, "KE", 2)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.08, cost, 0.0001)
+
+	_, err = EstimateCost(channel, "RW", -1)
+	assert.EqualError(t, err, "invalid segment count -1")
+}
+
+func TestURNSenders(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{})
+
+	// senders Mista already gives as URNs are used as they are
+	tcs := []struct {
+		data string
+		urn  string
+	}{
+		{"id=urn1&body=Hi&from=tel%3A%2B250788383383&to=2020", "tel:+250788383383"},
+		{"id=urn2&body=Hi&from=TEL%3A%2B250788383383&to=2020", "tel:+250788383383"},
+		{"id=urn3&body=Hi&from=%2B250788383383&to=2020", "tel:+250788383383"},
+	}
+	for _, tc := range tcs {
+		_, msg := receiveMsg(t, h, backend, channel, tc.data)
+		require.NotNil(t, msg, tc.data)
+		assert.Equal(t, tc.urn, msg.URN().String(), tc.data)
+	}
+
+	// but must be valid
+	w := httptest.NewRecorder()
+	h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=urn4&body=Hi&from=tel%3Anot-a-number&to=2020"))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid sender URN 'tel:not-a-number'")
+
+	// and can only be of other schemes if they're the channel's own
+	w = httptest.NewRecorder()
+	h.receiveMessage(context.Background(), channel, w, newFormRequest(receiveURL, "id=urn5&body=Hi&from=facebook%3A12345&to=2020"))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid sender URN 'facebook:12345': scheme 'facebook' isn't allowed on this channel")
+
+	channel.SetConfig(configURNScheme, urns.TelegramScheme)
+	_, msg := receiveMsg(t, h, backend, channel, "id=urn6&body=Hi&from=telegram%3A12345&to=2020")
+	assert.Equal(t, "telegram:12345", msg.URN().String())
+}
+
+func TestRelayedSendSlots(t *testing.T) {
+	server, _ := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	recorder := &metricsRecorder{}
+	h.metrics.gauge = recorder.gauge
+	channel := newSendChannel(map[string]interface{}{configRelayURL: server.URL, configSendRate: 20})
+
+	// relayed sends are throttled and tracked like direct ones
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		status, err := sendMsg(h, backend, channel, "Simple Message")
+		require.NoError(t, err)
+		assert.Equal(t, courier.MsgWired, status.Status())
+	}
+	assert.True(t, time.Since(start) >= 40*time.Millisecond, "second relayed send wasn't throttled")
+	assert.Contains(t, recorder.reported(), "courier.msg_send_in_flight_"+channelUUID+"=1")
+	assert.Empty(t, h.metrics.levels)
+
+	// and relays which accepted our message are wired even if we couldn't read what they said
+	truncating := newTruncatingServer("HTTP/1.1 200 OK")
+	defer truncating.Close()
+	status, err := sendMsg(h, backend, newSendChannel(map[string]interface{}{configRelayURL: truncating.URL}), "Simple Message")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "", status.ExternalID())
+}
+
+func TestPartChunks(t *testing.T) {
+	assert.Equal(t, [][]int{{0, 1, 2}, {3, 4, 5}, {6}}, partChunks(7, 3))
+	assert.Equal(t, [][]int{{0}, {1}}, partChunks(2, 1))
+	assert.Equal(t, [][]int{}, partChunks(0, 10))
+
+	var mutex sync.Mutex
+	inFlight, maxInFlight, requests := 0, 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		w.Write([]byte(`{"uid":"mx123"}`))
+	}))
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{
+		courier.ConfigBaseURL: server.URL, configSplitMessages: true, courier.ConfigMaxLength: 3, configMaxParts: 250,
+		configPartConcurrency: partConcurrencyConcurrent,
+	})
+
+	// large numbers of parts sent concurrently are sent a chunk at a time
+	text := strings.TrimSpace(strings.Repeat("abc ", 250))
+	status, err := sendMsg(h, backend, channel, text)
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	mutex.Lock()
+	assert.Equal(t, 250, requests)
+	assert.True(t, maxInFlight > 1 && maxInFlight <= defaultPartChunkSize, "max in flight %d", maxInFlight)
+	mutex.Unlock()
+
+	// and a chunk with a failed part stops any more being sent
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		w.WriteHeader(400)
+	}))
+	defer failing.Close()
+	channel.SetConfig(courier.ConfigBaseURL, failing.URL)
+	channel.SetConfig(configPartChunkSize, 4)
+	_, err = sendMsg(h, backend, channel, text)
+	assert.Error(t, err)
+	mutex.Lock()
+	assert.Equal(t, 254, requests)
+	mutex.Unlock()
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	server, bodies := newRecordingServer(`{"uid":"mx123"}`)
+	defer server.Close()
+
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	channel := newSendChannel(map[string]interface{}{
+		courier.ConfigBaseURL: server.URL, configSplitMessages: true, courier.ConfigMaxLength: 3, configMaxBatchSize: 3,
+	})
+
+	// messages within the batch size are sent as normal
+	status, err := sendMsg(h, backend, channel, "one two six")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Len(t, bodies(), 3)
+
+	// but those over it fail before anything is sent
+	status, err = sendMsg(h, backend, channel, "one two six ten")
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Equal(t, []string{"Batch Too Large"}, logDescriptions(status.Logs()))
+	assert.Contains(t, status.Logs()[0].Error, "message would be sent as 4 requests, more than the maximum batch size of 3")
+	assert.Len(t, bodies(), 3)
+
+	// including those which are over it because of their attachments
+	channel.SetConfig(configSplitAttachments, true)
+	msg := backend.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "one two six", false, nil, "", 0, "")
+	msg = msg.WithAttachment("image/jpeg:https://example.com/a.jpg").WithAttachment("image/jpeg:https://example.com/b.jpg")
+	status, err = h.SendMsg(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgFailed, status.Status())
+	assert.Len(t, bodies(), 3)
+}
+
+func TestTransportConfigChecks(t *testing.T) {
+	backend := test.NewMockBackend()
+	h := newTestHandler(backend)
+	receive := h.withTransportCheck(h.receiveMessage)
+	channel := newSendChannel(map[string]interface{}{configTLSMinVersion: "1.2"})
+
+	// valid settings aren't logged
+	_, err := receive(context.Background(), channel, httptest.NewRecorder(), newFormRequest(receiveURL, "id=tc1&body=Hi&from=%2B250788383383&to=2020"))
+	require.NoError(t, err)
+	assert.Empty(t, backend.ChannelLogs())
+
+	// invalid ones are as soon as we receive for the channel, without stopping it receiving, and only once
+	channel.SetConfig(configTLSMinVersion, "0.9")
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		_, err = receive(context.Background(), channel, w, newFormRequest(receiveURL, fmt.Sprintf("id=tc%d&body=Hi&from=%%2B250788383383&to=2020", i+2)))
+		require.NoError(t, err)
+		assert.Equal(t, 200, w.Code)
+	}
+	assert.Equal(t, []string{"Invalid Transport Config"}, logDescriptions(backend.ChannelLogs()))
+	assert.Contains(t, backend.ChannelLogs()[0].Error, "invalid TLS minimum version '0.9'")
+
+	// and again when they change to something else invalid, including on send
+	channel.SetConfig(configTLSCipherSuites, []interface{}{"TLS_RSA_WITH_RC4_128_SHA"})
+	channel.SetConfig(configTLSMinVersion, "")
+	_, err = sendMsg(h, backend, channel, "Simple Message")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"Invalid Transport Config", "Invalid Transport Config"}, logDescriptions(backend.ChannelLogs()))
+	assert.Contains(t, backend.ChannelLogs()[1].Error, "unsupported TLS cipher suite 'TLS_RSA_WITH_RC4_128_SHA'")
+}
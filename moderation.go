@@ -0,0 +1,30 @@
+package mista
+
+import (
+	"fmt"
+
+	"github.com/nyaruka/courier"
+)
+
+// contentModerator checks the text of an outgoing message, returning an error describing why if it's prohibited
+type contentModerator func(channel courier.Channel, text string) error
+
+// patternModerator prohibits any text matching one of the channel's prohibited patterns
+func patternModerator(channel courier.Channel, text string) error {
+	for _, pattern := range stringListConfigForKey(channel, configProhibitedPatterns) {
+		if matchesAnyPattern([]string{pattern}, text) {
+			return fmt.Errorf("message contains prohibited content matching '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// moderate runs the passed in text through each of our moderators, returning the first error
+func (h *handler) moderate(channel courier.Channel, text string) error {
+	for _, moderator := range h.moderators {
+		if err := moderator(channel, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
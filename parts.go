@@ -0,0 +1,66 @@
+package mista
+
+import (
+	"sync"
+
+	"github.com/nyaruka/courier"
+)
+
+// number of multipart messages we track the part statuses of at once
+const trackedPartsSize = 10000
+
+// partTracker remembers the statuses reported for each part of recent multipart messages so that a message is only
+// considered delivered once all of its parts are, evicting the oldest messages once full
+type partTracker struct {
+	mutex    sync.Mutex
+	size     int
+	messages map[string]map[int]courier.MsgStatusValue
+	order    []string
+}
+
+func newPartTracker(size int) *partTracker {
+	return &partTracker{size: size, messages: make(map[string]map[int]courier.MsgStatusValue, size)}
+}
+
+// record records the status of the given part of the passed in message, returning the status of the message as a
+// whole. That is failed if any part failed, errored if any part needs retrying, delivered if every part was delivered
+// and otherwise sent.
+func (t *partTracker) record(key string, part, parts int, status courier.MsgStatusValue) courier.MsgStatusValue {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	statuses, found := t.messages[key]
+	if !found {
+		if len(t.order) >= t.size {
+			delete(t.messages, t.order[0])
+			t.order = t.order[1:]
+		}
+		statuses = make(map[int]courier.MsgStatusValue, parts)
+		t.messages[key] = statuses
+		t.order = append(t.order, key)
+	}
+
+	// a failed part can't be undone by a later status for it
+	if statuses[part] != courier.MsgFailed {
+		statuses[part] = status
+	}
+
+	delivered, errored := 0, false
+	for _, s := range statuses {
+		switch s {
+		case courier.MsgFailed:
+			return courier.MsgFailed
+		case courier.MsgErrored:
+			errored = true
+		case courier.MsgDelivered:
+			delivered++
+		}
+	}
+	if errored {
+		return courier.MsgErrored
+	}
+	if delivered >= parts {
+		return courier.MsgDelivered
+	}
+	return courier.MsgSent
+}
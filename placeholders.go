@@ -0,0 +1,36 @@
+package mista
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// how placeholders which don't match any attribute are handled
+const (
+	unmatchedPlaceholdersLeave = "leave"
+	unmatchedPlaceholdersBlank = "blank"
+)
+
+// matches placeholders like {{name}} in the text of outgoing messages
+var placeholderRegex = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+
+// substitutePlaceholders replaces the placeholders in the passed in text with the matching attributes, leaving or
+// blanking any which don't match according to the given mode
+func substitutePlaceholders(text string, attributes map[string]interface{}, unmatched string) (string, error) {
+	if unmatched != unmatchedPlaceholdersLeave && unmatched != unmatchedPlaceholdersBlank {
+		return "", fmt.Errorf("unknown unmatched placeholders mode '%s', must be one of '%s' or '%s'", unmatched, unmatchedPlaceholdersLeave, unmatchedPlaceholdersBlank)
+	}
+
+	return placeholderRegex.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := placeholderRegex.FindStringSubmatch(placeholder)[1]
+
+		value, found := attributes[name]
+		if !found || value == nil {
+			if unmatched == unmatchedPlaceholdersBlank {
+				return ""
+			}
+			return placeholder
+		}
+		return fmt.Sprint(value)
+	}), nil
+}
@@ -0,0 +1,34 @@
+package mista
+
+import (
+	"github.com/nyaruka/courier"
+)
+
+// MessagePreview describes how a message would be sent without sending it
+type MessagePreview struct {
+	Text     string   `json:"text"`
+	Encoding string   `json:"encoding"`
+	Segments int      `json:"segments"`
+	Cost     *float64 `json:"cost,omitempty"`
+}
+
+// PreviewMessage previews how the passed in text would be sent on the given channel, including its estimated cost
+// if the channel has a configured cost per segment
+func PreviewMessage(text string, channel courier.Channel) (*MessagePreview, error) {
+	encoded, msgType, err := encodeText(channel, text)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &MessagePreview{
+		Text:     encoded,
+		Encoding: msgType,
+		Segments: segmentCount(encoded, msgType == "unicode"),
+	}
+
+	if segmentCost, hasCost := floatConfigForKey(channel, configSegmentCost); hasCost {
+		cost := segmentCost * float64(preview.Segments)
+		preview.Cost = &cost
+	}
+	return preview, nil
+}
@@ -0,0 +1,108 @@
+package mista
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/gocommon/urns"
+)
+
+// pseudonyms are stored as external URNs with this prefix so we can recognize them when replying
+const pseudonymPrefix = "mp_"
+
+// pseudonymCipher returns the cipher we use to create and reverse pseudonyms on the passed in channel, or nil if the
+// channel doesn't pseudonymize its senders
+func pseudonymCipher(channel courier.Channel) (cipher.AEAD, []byte, error) {
+	secret := channel.StringConfigForKey(configPseudonymKey, "")
+	if secret == "" {
+		return nil, nil, nil
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, key[:], nil
+}
+
+// pseudonymize replaces the passed in sender URN with an opaque external URN which only we can reverse, so that
+// deployments which can't store phone numbers can still reply to their contacts
+func pseudonymize(channel courier.Channel, urn urns.URN) (urns.URN, error) {
+	pseudonym, err := pseudonymFor(channel, urn.Path())
+	if err != nil || pseudonym == "" {
+		return urn, err
+	}
+	return urns.NewURNFromParts(urns.ExternalScheme, pseudonym, "", "")
+}
+
+// pseudonymFor returns the pseudonym of the passed in number on a channel, or empty string if the channel doesn't
+// pseudonymize its senders. The nonce is derived from the number so that each sender always gets the same pseudonym
+// and so stays the same contact.
+func pseudonymFor(channel courier.Channel, number string) (string, error) {
+	aead, key, err := pseudonymCipher(channel)
+	if err != nil || aead == nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(number))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := aead.Seal(nonce, nonce, []byte(number), nil)
+	return pseudonymPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// recipientRedactor returns a replacer which replaces the passed in recipient with its pseudonym in anything we log,
+// or nil if the channel doesn't pseudonymize numbers and so doesn't mind them being logged
+func recipientRedactor(channel courier.Channel, recipient string) (*strings.Replacer, error) {
+	pseudonym, err := pseudonymFor(channel, recipient)
+	if err != nil || pseudonym == "" || recipient == "" {
+		return nil, err
+	}
+
+	// Mista may give the number back to us escaped or without its plus, longest first so each is replaced whole
+	replacements := []string{url.QueryEscape(recipient), pseudonym, recipient, pseudonym}
+	if national := strings.TrimPrefix(recipient, "+"); national != recipient && national != "" {
+		replacements = append(replacements, national, pseudonym)
+	}
+	return strings.NewReplacer(replacements...), nil
+}
+
+// recipientForURN returns who the passed in URN should be sent to, which for pseudonyms is the number they replaced
+func recipientForURN(channel courier.Channel, urn urns.URN) (string, error) {
+	if urn.Scheme() != urns.ExternalScheme || !strings.HasPrefix(urn.Path(), pseudonymPrefix) {
+		return urn.Path(), nil
+	}
+
+	aead, _, err := pseudonymCipher(channel)
+	if err != nil {
+		return "", err
+	}
+	if aead == nil {
+		return "", errors.New("unable to send to pseudonymized contact, no pseudonym key set for channel")
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(urn.Path(), pseudonymPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid pseudonym '%s'", urn.Path())
+	}
+
+	recipient, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to reverse pseudonym '%s', it may have been created with a different key", urn.Path())
+	}
+	return string(recipient), nil
+}
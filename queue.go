@@ -0,0 +1,59 @@
+package mista
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// QueueStatus is how many messages for a channel are waiting at Mista to be sent to the networks
+type QueueStatus struct {
+	Queued    int
+	Scheduled int
+	OldestOn  *time.Time
+}
+
+// FetchQueueStatus fetches how many messages for the passed in channel are queued at Mista, to diagnose delivery
+// backlogs on the provider's side rather than ours
+func (h *handler) FetchQueueStatus(ctx context.Context, channel courier.Channel) (*QueueStatus, error) {
+	var response struct {
+		Queued    *int   `json:"queued"`
+		Pending   *int   `json:"pending"`
+		Scheduled int    `json:"scheduled"`
+		Oldest    string `json:"oldest_queued_on"`
+	}
+	err := h.callAPI(ctx, channel, http.MethodGet, endpointURL(channel, endpointQueue, nil), nil, &response)
+
+	// not every Mista deployment exposes its queue
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusNotFound {
+		return nil, errors.New("error fetching queue status: queue status not available for this account")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching queue status: %w", err)
+	}
+
+	// older deployments call queued messages pending
+	queued := response.Queued
+	if queued == nil {
+		queued = response.Pending
+	}
+	if queued == nil {
+		return nil, fmt.Errorf("queue status response missing queued count")
+	}
+
+	status := &QueueStatus{Queued: *queued, Scheduled: response.Scheduled}
+	if response.Oldest != "" {
+		oldest, err := time.Parse(time.RFC3339, response.Oldest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oldest queued date in queue status: %s", response.Oldest)
+		}
+		oldest = oldest.UTC()
+		status.OldestOn = &oldest
+	}
+	return status, nil
+}
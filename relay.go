@@ -0,0 +1,111 @@
+package mista
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// relayPayload is a message in courier's own format, as posted to a relay which forwards it on to Mista
+type relayPayload struct {
+	ID           courier.MsgID   `json:"id"`
+	UUID         string          `json:"uuid"`
+	ChannelUUID  string          `json:"channel_uuid"`
+	From         string          `json:"from"`
+	URN          string          `json:"urn"`
+	To           string          `json:"to"`
+	Text         string          `json:"text"`
+	Attachments  []string        `json:"attachments,omitempty"`
+	QuickReplies []string        `json:"quick_replies,omitempty"`
+	HighPriority bool            `json:"high_priority"`
+	Metadata     json.RawMessage `json:"metadata,omitempty"`
+}
+
+// newRelayPayload builds the relay payload for the passed in message to the given recipient
+func newRelayPayload(msg courier.Msg, recipient string) *relayPayload {
+	return &relayPayload{
+		ID:           msg.ID(),
+		UUID:         msg.UUID().String(),
+		ChannelUUID:  msg.Channel().UUID().String(),
+		From:         msg.Channel().Address(),
+		URN:          msg.URN().String(),
+		To:           recipient,
+		Text:         msg.Text(),
+		Attachments:  msg.Attachments(),
+		QuickReplies: msg.QuickReplies(),
+		HighPriority: msg.HighPriority(),
+		Metadata:     msg.Metadata(),
+	}
+}
+
+// relayMsg sends the passed in message via the relay at the given URL rather than directly to Mista
+func (h *handler) relayMsg(ctx context.Context, msg courier.Msg, metadata *msgMetadata, recipient string, relayURL string) (courier.MsgStatus, error) {
+	if err := validateSendURL(relayURL, msg.Channel().BoolConfigForKey(configInsecure, false)); err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	body, err := json.Marshal(newRelayPayload(msg, recipient))
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	// the relay needs the number to send to, but deployments which can't store numbers mustn't have it in their logs
+	redact, err := recipientRedactor(msg.Channel(), recipient)
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseBuild, err)
+	}
+
+	request := &sendRequest{
+		body: body,
+		headers: map[string]string{
+			"Accept":       "application/json",
+			"Content-Type": "application/json",
+		},
+		timeout: sendTimeout(msg, metadata),
+		redact:  redact,
+	}
+	if msg.Channel().BoolConfigForKey(configIdempotencyKey, false) {
+		request.headers["Idempotency-Key"] = h.idempotencyKey(msg.Channel(), msg.ID(), msg.Channel().Address(), 0)
+	}
+
+	// relayed sends count against the same rate limits and take the same turns as direct ones
+	release, err := h.acquireSendSlot(ctx, msg.Channel())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+
+	// the relay accepted our message even if we couldn't read its response, so it's sent, we just don't know its UID
+	resp, respBody, err := h.sendWithRetries(ctx, msg, status, []string{relayURL}, request)
+	var readErr *bodyReadError
+	if errors.As(err, &readErr) && resp.StatusCode/100 == 2 {
+		err = nil
+	}
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseTransport, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, h.sendFailure(msg, sendPhaseTransport, &rejectionError{statusCode: resp.StatusCode, body: string(respBody)})
+	}
+
+	// relays may pass back the UID Mista gave the message, as a string or a number, but aren't required to
+	var response struct {
+		UID json.RawMessage `json:"uid"`
+	}
+	if json.Unmarshal(respBody, &response) == nil {
+		status.SetExternalID(normalizeUID(msg.Channel(), rawString(response.UID)))
+	}
+
+	status.SetStatus(acceptedStatus(msg.Channel()))
+	h.sendTimes.record(msg.Channel(), msg.ID(), status.ExternalID(), time.Now())
+
+	if !h.logSampler.sample(msg.Channel(), msg.Channel().IntConfigForKey(configLogSampleRate, 1)) {
+		return h.withoutSuccessLogs(msg, status), nil
+	}
+	return status, nil
+}
@@ -0,0 +1,47 @@
+package mista
+
+import (
+	"sync"
+
+	"github.com/nyaruka/courier"
+)
+
+// logSampler counts the successful sends on each channel to decide which of them keep their channel logs
+type logSampler struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func newLogSampler() *logSampler {
+	return &logSampler{counts: make(map[string]int)}
+}
+
+// sample returns whether the next successful send on the passed in channel should keep its logs, which is 1 in every
+// rate sends
+func (s *logSampler) sample(channel courier.Channel, rate int) bool {
+	if rate <= 1 {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := channel.UUID().String()
+	sampled := s.counts[key]%rate == 0
+	s.counts[key]++
+	return sampled
+}
+
+// withoutSuccessLogs returns a copy of the passed in status of a successful send which only keeps the logs of anything
+// that went wrong along the way
+func (h *handler) withoutSuccessLogs(msg courier.Msg, status courier.MsgStatus) courier.MsgStatus {
+	sampled := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), status.Status())
+	sampled.SetExternalID(status.ExternalID())
+
+	for _, log := range status.Logs() {
+		if log.Error != "" {
+			sampled.AddLog(log)
+		}
+	}
+	return sampled
+}
@@ -0,0 +1,120 @@
+package mista
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// maximum number of sends to Mista which can be in flight at once across all channels, unlimited unless set
+var maxConcurrentSends, _ = strconv.Atoi(os.Getenv("COURIER_MISTA_MAX_CONCURRENT_SENDS"))
+
+// fairScheduler hands out a fixed number of send slots, serving waiting channels in round robin order rather than
+// first come first served so that one busy channel can't starve the others. Without any slots sends are unlimited.
+type fairScheduler struct {
+	unlimited bool
+
+	mutex  sync.Mutex
+	free   int
+	queues map[string][]chan struct{}
+	order  []string
+}
+
+func newFairScheduler(slots int) *fairScheduler {
+	return &fairScheduler{unlimited: slots <= 0, free: slots, queues: make(map[string][]chan struct{})}
+}
+
+// acquire blocks until a send slot is available for the passed in channel key, returning a function which must be
+// called to release it
+func (s *fairScheduler) acquire(ctx context.Context, key string) (func(), error) {
+	if s.unlimited {
+		return func() {}, nil
+	}
+
+	s.mutex.Lock()
+	if s.free > 0 && len(s.order) == 0 {
+		s.free--
+		s.mutex.Unlock()
+		return s.release, nil
+	}
+
+	ready := make(chan struct{})
+	if len(s.queues[key]) == 0 {
+		s.order = append(s.order, key)
+	}
+	s.queues[key] = append(s.queues[key], ready)
+	s.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return s.release, nil
+
+	case <-ctx.Done():
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		select {
+		case <-ready:
+			// we were handed a slot just as we gave up, pass it on
+			s.handOff()
+		default:
+			s.dequeue(key, ready)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release gives a slot back to the scheduler
+func (s *fairScheduler) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.handOff()
+}
+
+// handOff passes a slot to the first waiter of the next channel in line, moving that channel to the back of the line
+// if it has more waiters, or returns the slot to the pool if nobody is waiting. Must be called with the mutex held.
+func (s *fairScheduler) handOff() {
+	if len(s.order) == 0 {
+		s.free++
+		return
+	}
+
+	key := s.order[0]
+	s.order = s.order[1:]
+
+	waiters := s.queues[key]
+	close(waiters[0])
+
+	if len(waiters) > 1 {
+		s.queues[key] = waiters[1:]
+		s.order = append(s.order, key)
+	} else {
+		delete(s.queues, key)
+	}
+}
+
+// dequeue removes the passed in waiter for a channel. Must be called with the mutex held.
+func (s *fairScheduler) dequeue(key string, ready chan struct{}) {
+	waiters := s.queues[key]
+	for i, w := range waiters {
+		if w == ready {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) > 0 {
+		s.queues[key] = waiters
+		return
+	}
+
+	delete(s.queues, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
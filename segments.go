@@ -0,0 +1,92 @@
+package mista
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+// number of characters which fit in single and multipart segments for each encoding
+const (
+	gsm7SingleSegment = 160
+	gsm7MultiSegment  = 153
+	ucs2SingleSegment = 70
+	ucs2MultiSegment  = 67
+)
+
+// characters from the GSM7 extension table which take two characters to encode
+const gsm7Extended = "^{}\\[~]|€\f"
+
+// charLength returns the number of encoded characters needed for the passed in rune
+func charLength(r rune, unicode bool) int {
+	if unicode {
+		return len(utf16.Encode([]rune{r}))
+	}
+	if strings.ContainsRune(gsm7Extended, r) {
+		return 2
+	}
+	return 1
+}
+
+// textLength returns the number of encoded characters needed for the passed in text
+func textLength(text string, unicode bool) int {
+	length := 0
+	for _, r := range text {
+		length += charLength(r, unicode)
+	}
+	return length
+}
+
+// segmentSizes returns the single and multipart segment sizes for the passed in encoding
+func segmentSizes(unicode bool) (int, int) {
+	if unicode {
+		return ucs2SingleSegment, ucs2MultiSegment
+	}
+	return gsm7SingleSegment, gsm7MultiSegment
+}
+
+// segmentCount returns the number of segments the passed in text will be sent as
+func segmentCount(text string, unicode bool) int {
+	single, multi := segmentSizes(unicode)
+	length := textLength(text, unicode)
+	if length <= single {
+		return 1
+	}
+	return (length + multi - 1) / multi
+}
+
+// truncateToSegments truncates the passed in text so that it fits into the given number of segments
+func truncateToSegments(text string, unicode bool, segments int) string {
+	single, multi := segmentSizes(unicode)
+	limit := single
+	if segments > 1 {
+		limit = multi * segments
+	}
+
+	length := 0
+	for i, r := range text {
+		length += charLength(r, unicode)
+		if length > limit {
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// splitHard splits the passed in text into parts of exactly the given number of characters, the last part holding
+// whatever is left
+func splitHard(text string, maxLength int) []string {
+	runes := []rune(text)
+	if maxLength <= 0 || len(runes) <= maxLength {
+		return []string{text}
+	}
+
+	parts := make([]string, 0, (len(runes)+maxLength-1)/maxLength)
+	for start := 0; start < len(runes); start += maxLength {
+		end := start + maxLength
+		if end > len(runes) {
+			end = len(runes)
+		}
+		parts = append(parts, string(runes[start:end]))
+	}
+	return parts
+}
@@ -0,0 +1,519 @@
+package mista
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// the phases of a send which can fail
+const (
+	sendPhaseBuild     = "build"
+	sendPhaseTransport = "transport"
+	sendPhaseParse     = "parse"
+)
+
+// sendError is an error from sending a message, tagged with the phase of the send which failed
+type sendError struct {
+	phase string
+	err   error
+}
+
+func (e *sendError) Error() string { return fmt.Sprintf("%s error: %s", e.phase, e.err) }
+func (e *sendError) Unwrap() error { return e.err }
+
+// sendFailure wraps the passed in error with the phase of the send which failed, recording the failure in our metrics
+func (h *handler) sendFailure(msg courier.Msg, phase string, err error) error {
+	h.metrics.sendFailed(msg.Channel(), phase)
+	return &sendError{phase: phase, err: err}
+}
+
+// sendURLsForChannel returns the endpoints to send to the passed in recipient on a channel in order of preference
+func sendURLsForChannel(channel courier.Channel, recipient string) []string {
+	if routed := routeForRecipient(stringMapConfigForKey(channel, configPrefixRoutes), recipient); routed != "" {
+		return []string{routed}
+	}
+
+	urls := stringListConfigForKey(channel, configSendURLs)
+	if len(urls) > 0 {
+		return urls
+	}
+	if sendURL := channel.StringConfigForKey(courier.ConfigSendURL, ""); sendURL != "" {
+		return []string{sendURL}
+	}
+	return []string{endpointURL(channel, endpointSend, nil)}
+}
+
+// routeForRecipient returns the endpoint of the longest dialing code prefix in the passed in routes which matches the
+// recipient, or empty string if none match
+func routeForRecipient(routes map[string]string, recipient string) string {
+	recipient = strings.TrimPrefix(recipient, "+")
+
+	longest, endpoint := 0, ""
+	for prefix, routeURL := range routes {
+		prefix = strings.TrimPrefix(prefix, "+")
+		if prefix != "" && len(prefix) > longest && strings.HasPrefix(recipient, prefix) {
+			longest, endpoint = len(prefix), routeURL
+		}
+	}
+	return endpoint
+}
+
+// validateSendURL checks that the passed in send URL is absolute and uses https, unless the channel is insecure
+func validateSendURL(rawURL string, insecure bool) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid send URL '%s': %w", rawURL, err)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("invalid send URL '%s': missing host", rawURL)
+	}
+	if parsed.Scheme != "https" && !(insecure && parsed.Scheme == "http") {
+		return fmt.Errorf("invalid send URL '%s': scheme must be https", rawURL)
+	}
+	return nil
+}
+
+// how the body of send requests can be encoded
+const (
+	sendEncodingJSON = "json"
+	sendEncodingForm = "form"
+)
+
+// encodeSendBody encodes the passed in payload as a request body in the given encoding, returning it and its content type
+func encodeSendBody(payload interface{}, encoding string) ([]byte, string, error) {
+	marshalled, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch encoding {
+	case sendEncodingJSON:
+		return marshalled, "application/json", nil
+
+	case sendEncodingForm:
+		fields := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(marshalled))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, "", err
+		}
+
+		// scalar values are sent as is, anything structured is sent as JSON
+		form := url.Values{}
+		for key, value := range fields {
+			switch v := value.(type) {
+			case string:
+				form.Set(key, v)
+			case json.Number:
+				form.Set(key, v.String())
+			case bool:
+				form.Set(key, strconv.FormatBool(v))
+			case nil:
+			default:
+				encoded, err := json.Marshal(v)
+				if err != nil {
+					return nil, "", err
+				}
+				form.Set(key, string(encoded))
+			}
+		}
+		return []byte(form.Encode()), "application/x-www-form-urlencoded", nil
+	}
+
+	return nil, "", fmt.Errorf("unknown send encoding '%s', must be one of 'json' or 'form'", encoding)
+}
+
+// sendRequest is a send request which can be made to any of our endpoints, if it has a compressed body then that's what
+// we send, the uncompressed body being kept for logging
+type sendRequest struct {
+	body       []byte
+	compressed []byte
+	headers    map[string]string
+	timeout    time.Duration
+
+	// replaces anything in what we log about this request which the channel doesn't want stored, if anything
+	redact *strings.Replacer
+}
+
+// redacted returns the passed in text, as logged for this request, with anything we shouldn't store replaced
+func (r *sendRequest) redacted(text string) string {
+	if r.redact == nil {
+		return text
+	}
+	return r.redact.Replace(text)
+}
+
+// compress gzips the body of this request, which Mista accepts to reduce the size of large payloads
+func (r *sendRequest) compress() error {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(r.body); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	r.compressed = buf.Bytes()
+	r.headers["Content-Encoding"] = "gzip"
+	return nil
+}
+
+// how long we wait before the first retry of a send to the same endpoint, doubling with each retry after that up to
+// the maximum
+var (
+	retryBackoff    = 250 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// backoffForRetry returns how long to wait before the passed in retry of a send to the same endpoint
+func backoffForRetry(retry int) time.Duration {
+	backoff := retryBackoff
+	for i := 1; i < retry && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// sendWithRetries makes the passed in send request, retrying each endpoint up to the channel's configured number of
+// retries before failing over to the next. As retrying a request Mista may have accepted would duplicate the message,
+// we only try again if the request was idempotent or it clearly failed before Mista could have accepted it.
+func (h *handler) sendWithRetries(ctx context.Context, msg courier.Msg, status channelLogger, endpoints []string, request *sendRequest) (*http.Response, []byte, error) {
+	client, err := h.clientForChannel(msg.Channel())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// every endpoint gets at least one attempt, however the channel is configured
+	maxRetries := msg.Channel().IntConfigForKey(configMaxRetries, 0)
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	retryable := stringListConfigForKey(msg.Channel(), configRetryStatusCodes)
+	if len(retryable) == 0 {
+		retryable = defaultRetryStatusCodes
+	}
+	_, idempotent := request.headers["Idempotency-Key"]
+
+	var resp *http.Response
+	var respBody []byte
+
+	for _, endpoint := range endpoints {
+		for attempt := 0; attempt <= maxRetries; attempt++ {
+			// give whatever made the last attempt fail a moment to clear before trying the same endpoint again
+			if attempt > 0 {
+				select {
+				case <-time.After(backoffForRetry(attempt)):
+				case <-ctx.Done():
+				}
+			}
+
+			// once courier's deadline for the send has passed, further attempts can only fail
+			if ctx.Err() != nil {
+				return resp, respBody, fmt.Errorf("send deadline exceeded: %w", ctx.Err())
+			}
+
+			h.metrics.sendAttempted(msg.Channel())
+
+			start := time.Now()
+			resp, respBody, err = makeSendRequest(ctx, client, endpoint, request)
+			elapsed := time.Since(start)
+
+			if err != nil {
+				status.AddLog(courier.NewChannelLogFromError("Message Send Error", msg.Channel(), msg.ID(), elapsed, fmt.Errorf("error sending to %s: %w", endpoint, err)))
+
+				// if we got a response at all then Mista received our request, so trying again could duplicate it
+				var readErr *bodyReadError
+				if errors.As(err, &readErr) {
+					return resp, nil, err
+				}
+				if !idempotent && !isPreAcceptanceError(err) {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			status.AddLog(courier.NewChannelLog("Message Sent", msg.Channel(), msg.ID(), http.MethodPost, endpoint, resp.StatusCode, request.redacted(string(request.body)), request.redacted(string(respBody)), elapsed, nil))
+
+			// retryable statuses like server errors mean the request wasn't accepted so can be safely tried again,
+			// anything else is final
+			if !isRetryableStatus(retryable, resp.StatusCode) {
+				return resp, respBody, nil
+			}
+		}
+	}
+
+	return resp, respBody, err
+}
+
+// the status codes we retry sends on by default, where a code like 5xx matches any code in that class
+var defaultRetryStatusCodes = []string{"429", "5xx"}
+
+// isRetryableStatus returns whether the passed in response status code matches any of the given retryable codes
+func isRetryableStatus(retryable []string, statusCode int) bool {
+	code := strconv.Itoa(statusCode)
+	for _, r := range retryable {
+		r = strings.ToLower(r)
+		if r == code || (len(r) == 3 && strings.HasSuffix(r, "xx") && r[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches Mista rejections because a sandbox account tried to send to a number which hasn't been verified
+var sandboxRestrictionRegex = regexp.MustCompile(`(?i)sandbox\b.*\b(not verified|unverified|verified numbers?)\b`)
+
+// matches Mista rejections because our sender ID isn't allowed for the destination, such as alphanumeric senders in
+// countries which ban them
+var senderRejectedRegex = regexp.MustCompile(`(?i)\bsender(\s*id)?\b.*\b(rejected|invalid|not allowed|not permitted|banned|blocked|blacklisted|barred|unregistered)\b`)
+
+// rejectionError is returned when Mista responds to a send with a non-success status code
+type rejectionError struct {
+	statusCode int
+	body       string
+}
+
+func (e *rejectionError) Error() string {
+	return fmt.Sprintf("SMS request failed with status code: %d", e.statusCode)
+}
+
+// sendResult is what we get back from Mista for a successful send
+type sendResult struct {
+	uid     string
+	balance *float64
+	cost    *float64
+	parts   int
+}
+
+// sendPart makes the passed in send request for part of a message, returning what Mista told us about it
+func (h *handler) sendPart(ctx context.Context, msg courier.Msg, status channelLogger, endpoints []string, request *sendRequest) (*sendResult, error) {
+	resp, respBody, err := h.sendWithRetries(ctx, msg, status, endpoints, request)
+
+	// Mista accepted our message even if we couldn't read its response, so it's sent, we just don't know its UID
+	var readErr *bodyReadError
+	if errors.As(err, &readErr) && resp.StatusCode/100 == 2 {
+		return &sendResult{}, nil
+	}
+	if err != nil {
+		return nil, h.sendFailure(msg, sendPhaseTransport, err)
+	}
+
+	// Check the response status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, h.sendFailure(msg, sendPhaseTransport, &rejectionError{statusCode: resp.StatusCode, body: string(respBody)})
+	}
+
+	// Parse the response body to extract the necessary information, from wherever this variant of Mista puts it
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(respBody))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, h.sendFailure(msg, sendPhaseParse, err)
+	}
+
+	// some variants accept the request but report the send as failed in the response
+	sendStatus := pointerString(doc, jsonPathPointer(msg.Channel().StringConfigForKey(configResponseStatusPath, "status")))
+	if failedResponseStatuses[strings.ToLower(sendStatus)] {
+		return nil, h.sendFailure(msg, sendPhaseTransport, &rejectionError{statusCode: resp.StatusCode, body: string(respBody)})
+	}
+
+	// UIDs are strings on most accounts but numbers on some, which we decode as numbers so they're returned exactly
+	uid := pointerString(doc, jsonPathPointer(msg.Channel().StringConfigForKey(configResponseUIDPath, "uid")))
+	result := &sendResult{
+		uid:     normalizeUID(msg.Channel(), uid),
+		balance: pointerFloat(doc, "/balance"),
+		cost:    pointerFloat(doc, "/cost"),
+	}
+	if parts := pointerFloat(doc, "/parts"); parts != nil {
+		result.parts = int(*parts)
+	}
+	return result, nil
+}
+
+// channelLogger is anything we can log a send against, usually the status of the message being sent
+type channelLogger interface {
+	AddLog(log *courier.ChannelLog)
+}
+
+// logCollector collects the logs of a part being sent concurrently, so they can be added to the message's status in
+// part order once every part has been sent
+type logCollector struct {
+	logs []*courier.ChannelLog
+}
+
+func (c *logCollector) AddLog(log *courier.ChannelLog) { c.logs = append(c.logs, log) }
+
+// sendParts sends each of the passed in requests for the parts of a message, returning the result or error of each
+// by part. Parts are sent in chunks of the given size, with the parts of each chunk sent concurrently and every part
+// of a chunk sent regardless, but we stop before the next chunk if any part failed, so sending one part at a time
+// stops at the first part which fails. If a part's sender is rejected we try it again once from our fallback sender
+// and then stick with that for the rest.
+func (h *handler) sendParts(ctx context.Context, msg courier.Msg, status courier.MsgStatus, endpoints []string, requests []*sendRequest, fallbackRequests []*sendRequest, fallbackSender string, chunkSize int) ([]*sendResult, []error) {
+	results := make([]*sendResult, len(requests))
+	errs := make([]error, len(requests))
+
+	var fallbackLock sync.Mutex
+	useFallback := false
+
+	sendPart := func(i int, logs channelLogger) (*sendResult, error) {
+		fallbackLock.Lock()
+		fallback := useFallback
+		fallbackLock.Unlock()
+
+		if fallback {
+			return h.sendPart(ctx, msg, logs, endpoints, fallbackRequests[i])
+		}
+
+		result, err := h.sendPart(ctx, msg, logs, endpoints, requests[i])
+
+		var rejectErr *rejectionError
+		if fallbackRequests != nil && errors.As(err, &rejectErr) && senderRejectedRegex.MatchString(rejectErr.body) {
+			logs.AddLog(courier.NewChannelLogFromError("Sender Rejected", msg.Channel(), msg.ID(), 0, fmt.Errorf("sender rejected, retrying from '%s'", fallbackSender)))
+
+			fallbackLock.Lock()
+			useFallback = true
+			fallbackLock.Unlock()
+
+			return h.sendPart(ctx, msg, logs, endpoints, fallbackRequests[i])
+		}
+		return result, err
+	}
+
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+
+	for _, chunk := range partChunks(len(requests), chunkSize) {
+		if !sendChunk(status, chunk, results, errs, sendPart) {
+			break
+		}
+	}
+	return results, errs
+}
+
+// partChunks returns the indexes of each chunk of at most the passed in size that the given number of parts are sent in
+func partChunks(parts int, size int) [][]int {
+	chunks := make([][]int, 0, (parts+size-1)/size)
+	for start := 0; start < parts; start += size {
+		chunk := make([]int, 0, size)
+		for i := start; i < parts && i < start+size; i++ {
+			chunk = append(chunk, i)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// sendChunk sends the passed in chunk of parts at once, recording the result or error of each, and returns whether
+// they were all sent
+func sendChunk(status courier.MsgStatus, chunk []int, results []*sendResult, errs []error, sendPart func(int, channelLogger) (*sendResult, error)) bool {
+	if len(chunk) == 1 {
+		results[chunk[0]], errs[chunk[0]] = sendPart(chunk[0], status)
+		return errs[chunk[0]] == nil
+	}
+
+	collectors := make([]*logCollector, len(chunk))
+	wg := sync.WaitGroup{}
+	for c, i := range chunk {
+		collectors[c] = &logCollector{}
+		wg.Add(1)
+
+		go func(i int, logs channelLogger) {
+			defer wg.Done()
+			results[i], errs[i] = sendPart(i, logs)
+		}(i, collectors[c])
+	}
+	wg.Wait()
+
+	sent := true
+	for c, collector := range collectors {
+		for _, log := range collector.logs {
+			status.AddLog(log)
+		}
+		if errs[chunk[c]] != nil {
+			sent = false
+		}
+	}
+	return sent
+}
+
+// statuses in the response to a send which mean it failed even though it was accepted
+var failedResponseStatuses = map[string]bool{"error": true, "failed": true, "rejected": true}
+
+// isPreAcceptanceError returns whether the passed in transport error happened before our request could have reached
+// Mista, such as failing to resolve or connect to the host
+func isPreAcceptanceError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// bodyReadError is returned when we got a response from Mista but couldn't read its body
+type bodyReadError struct {
+	err error
+}
+
+func (e *bodyReadError) Error() string { return fmt.Sprintf("error reading response body: %s", e.err) }
+func (e *bodyReadError) Unwrap() error { return e.err }
+
+// makeSendRequest makes the passed in send request to the given URL, returning the response and its read body
+func makeSendRequest(ctx context.Context, client httpClient, endpoint string, request *sendRequest) (*http.Response, []byte, error) {
+	// our configured timeout only applies if it's sooner than any deadline courier gave us for the whole send
+	ctx, cancel := context.WithTimeout(ctx, request.timeout)
+	defer cancel()
+
+	body := request.body
+	if request.compressed != nil {
+		body = request.compressed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range request.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, &bodyReadError{err: err}
+	}
+
+	return resp, respBody, nil
+}
@@ -0,0 +1,93 @@
+package mista
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/gocommon/urns"
+)
+
+// urnBuilder builds the URN of the sender of an incoming message on the passed in channel
+type urnBuilder func(channel courier.Channel, sender string) (urns.URN, error)
+
+// telURNBuilder treats senders as phone numbers, local numbers being parsed for the channel's country
+func telURNBuilder(channel courier.Channel, sender string) (urns.URN, error) {
+	return handlers.StrictTelForCountry(sender, channel.Country())
+}
+
+// externalURNBuilder treats senders as opaque identifiers
+func externalURNBuilder(channel courier.Channel, sender string) (urns.URN, error) {
+	return urns.NewURNFromParts(urns.ExternalScheme, sender, "", "")
+}
+
+// whatsAppURNBuilder treats senders as WhatsApp numbers, which are identified without a leading +
+func whatsAppURNBuilder(channel courier.Channel, sender string) (urns.URN, error) {
+	return urns.NewWhatsAppURN(strings.TrimPrefix(sender, "+"))
+}
+
+// defaultURNBuilders are the URN builders available to channels by the scheme they're configured with
+var defaultURNBuilders = map[string]urnBuilder{
+	urns.TelScheme:      telURNBuilder,
+	urns.ExternalScheme: externalURNBuilder,
+	urns.WhatsAppScheme: whatsAppURNBuilder,
+}
+
+// the URN schemes of the sources Mista bridges inbound messages from, anything else being from the channel's own scheme
+var sourceSchemes = map[string]string{
+	"whatsapp": urns.WhatsAppScheme,
+	"wa":       urns.WhatsAppScheme,
+}
+
+// senderURN builds the URN of the passed in sender, using the builder for the scheme of the source Mista says the
+// message came from if it's bridged from elsewhere, otherwise the channel's configured scheme
+func (h *handler) senderURN(channel courier.Channel, source string, sender string) (urns.URN, error) {
+	scheme := channel.StringConfigForKey(configURNScheme, urns.TelScheme)
+
+	// bridged messages are identified either by their source or by the sender being prefixed with its scheme, and
+	// senders which are already URNs are used as they are
+	if sourceScheme, found := sourceSchemes[strings.ToLower(strings.TrimSpace(source))]; found {
+		scheme = sourceScheme
+	} else if strings.HasPrefix(strings.ToLower(sender), urns.WhatsAppScheme+":") {
+		scheme = urns.WhatsAppScheme
+		sender = sender[len(urns.WhatsAppScheme)+1:]
+	} else if urn, isURN, err := prefixedURN(sender, scheme); isURN {
+		return urn, err
+	}
+
+	builder, found := h.urnBuilders[scheme]
+	if !found {
+		schemes := make([]string, 0, len(h.urnBuilders))
+		for s := range h.urnBuilders {
+			schemes = append(schemes, fmt.Sprintf("'%s'", s))
+		}
+		sort.Strings(schemes)
+		return urns.NilURN, fmt.Errorf("unknown URN scheme '%s', must be one of %s", scheme, strings.Join(schemes, ", "))
+	}
+	return builder(channel, sender)
+}
+
+// prefixedURN parses the passed in sender if Mista already gave it to us as a URN like tel:+250788123123, which we use
+// as is rather than normalizing it again, returning false if it isn't one. Senders can't choose what kind of contact
+// they are though, so only tel URNs and those of the channel's own scheme are allowed.
+func prefixedURN(sender string, channelScheme string) (urns.URN, bool, error) {
+	parts := strings.SplitN(sender, ":", 2)
+	scheme := strings.ToLower(parts[0])
+	if len(parts) != 2 || !urns.IsValidScheme(scheme) {
+		return urns.NilURN, false, nil
+	}
+	if scheme != urns.TelScheme && scheme != channelScheme {
+		return urns.NilURN, true, fmt.Errorf("invalid sender URN '%s': scheme '%s' isn't allowed on this channel", sender, scheme)
+	}
+
+	urn, err := urns.Parse(scheme + ":" + parts[1])
+	if err != nil {
+		return urns.NilURN, true, fmt.Errorf("invalid sender URN '%s': %w", sender, err)
+	}
+	if err := urn.Validate(); err != nil {
+		return urns.NilURN, true, fmt.Errorf("invalid sender URN '%s': %w", sender, err)
+	}
+	return urn, true, nil
+}
@@ -0,0 +1,84 @@
+package mista
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// number of recently sent messages we remember the send times of to measure their delivery latency
+const sendTimesSize = 10000
+
+// sendTimes remembers when recent messages were sent, by both their ID and the UID Mista gave them, evicting the
+// oldest once full
+type sendTimes struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]time.Time
+	order   []string
+}
+
+func newSendTimes(size int) *sendTimes {
+	return &sendTimes{size: size, entries: make(map[string]time.Time, size)}
+}
+
+func sendTimeKeys(channel courier.Channel, msgID courier.MsgID, uid string) []string {
+	keys := make([]string, 0, 2)
+	if msgID != courier.NilMsgID {
+		keys = append(keys, channel.UUID().String()+":id:"+msgID.String())
+	}
+	if uid != "" {
+		keys = append(keys, channel.UUID().String()+":uid:"+uid)
+	}
+	return keys
+}
+
+// record records that the passed in message was sent at the given time
+func (t *sendTimes) record(channel courier.Channel, msgID courier.MsgID, uid string, sentOn time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range sendTimeKeys(channel, msgID, uid) {
+		if _, found := t.entries[key]; !found {
+			if len(t.order) >= t.size {
+				delete(t.entries, t.order[0])
+				t.order = t.order[1:]
+			}
+			t.order = append(t.order, key)
+		}
+		t.entries[key] = sentOn
+	}
+}
+
+// sentOn returns when the message with the passed in ID or UID was sent, if we know
+func (t *sendTimes) sentOn(channel courier.Channel, msgID courier.MsgID, uid string) (time.Time, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range sendTimeKeys(channel, msgID, uid) {
+		if sentOn, found := t.entries[key]; found {
+			return sentOn, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// latencyLog returns a log recording how long the message with the passed in ID or UID took to reach its final
+// status, or nil if the status isn't final or we don't know when the message was sent
+func (h *handler) latencyLog(channel courier.Channel, msgID courier.MsgID, uid string, status courier.MsgStatusValue) *courier.ChannelLog {
+	if status != courier.MsgDelivered && status != courier.MsgFailed {
+		return nil
+	}
+
+	sentOn, found := h.sendTimes.sentOn(channel, msgID, uid)
+	if !found {
+		return nil
+	}
+
+	latency := time.Since(sentOn)
+	description := fmt.Sprintf("final status '%s' after %s", status, latency.Round(time.Millisecond))
+	return courier.NewChannelLog("Delivery Latency", channel, msgID, "", "", http.StatusOK, "", description, latency, nil)
+}
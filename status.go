@@ -0,0 +1,468 @@
+package mista
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/sirupsen/logrus"
+)
+
+type statusForm struct {
+	ID           string `validate:"required" name:"id"`
+	Status       string `validate:"required" name:"status"`
+	Metadata     string `name:"metadata"`
+	Reference    string `name:"reference"`
+	ErrorCode    string `name:"error_code"`
+	ErrorMessage string `name:"error_message"`
+	DeliveredTo  string `name:"delivered_to"`
+	Part         string `name:"part"`
+	Parts        string `name:"parts"`
+}
+
+// statusItem is a single status posted as JSON, either on its own or in a batch of statuses. Version 1 statuses have
+// their delivery details at the top level whereas version 2 statuses nest them in a report.
+type statusItem struct {
+	ID          json.RawMessage `json:"id"`
+	Status      json.RawMessage `json:"status"`
+	Metadata    json.RawMessage `json:"metadata"`
+	Reference   string          `json:"reference"`
+	ErrorCode   string          `json:"error_code"`
+	DeliveredTo string          `json:"delivered_to"`
+	Part        json.RawMessage `json:"part"`
+	Parts       json.RawMessage `json:"parts"`
+	Report      *statusReport   `json:"report"`
+}
+
+// statusReport is the delivery report nested in a version 2 status
+type statusReport struct {
+	Status       json.RawMessage `json:"status"`
+	ErrorCode    json.RawMessage `json:"error_code"`
+	ErrorMessage string          `json:"error_message"`
+	DeliveredTo  string          `json:"delivered_to"`
+}
+
+// form converts this item to the same form as a status posted as form values
+func (i *statusItem) form() *statusForm {
+	form := &statusForm{
+		ID:          rawString(i.ID),
+		Status:      rawString(i.Status),
+		Reference:   i.Reference,
+		ErrorCode:   i.ErrorCode,
+		DeliveredTo: i.DeliveredTo,
+		Part:        rawString(i.Part),
+		Parts:       rawString(i.Parts),
+	}
+
+	if i.Report != nil {
+		form.Status = rawString(i.Report.Status)
+		form.ErrorCode = firstNonEmpty(rawString(i.Report.ErrorCode), form.ErrorCode)
+		form.ErrorMessage = i.Report.ErrorMessage
+		form.DeliveredTo = firstNonEmpty(i.Report.DeliveredTo, form.DeliveredTo)
+	}
+
+	// metadata can be a JSON object or a JSON encoded string
+	if len(i.Metadata) > 0 && string(i.Metadata) != "null" {
+		if err := json.Unmarshal(i.Metadata, &form.Metadata); err != nil {
+			form.Metadata = string(i.Metadata)
+		}
+	}
+	return form
+}
+
+// rawString returns the passed in raw JSON value, which can be a string, number or boolean, as a string. Numbers are
+// returned exactly as Mista wrote them so large numeric UIDs don't lose precision.
+func rawString(raw json.RawMessage) string {
+	var value string
+	if json.Unmarshal(raw, &value) == nil {
+		return value
+	}
+	if string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
+
+// isJSONArray returns whether the passed in body looks like a JSON array
+func isJSONArray(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// isV2Status returns whether the passed in body is a version 2 status, either because the channel is configured to
+// use that version of the API or because it has a nested report
+func isV2Status(channel courier.Channel, body []byte) bool {
+	if channel.StringConfigForKey(configAPIVersion, "") == apiVersionV2 {
+		return true
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
+	}
+
+	var probe struct {
+		Report json.RawMessage `json:"report"`
+	}
+	return json.Unmarshal(trimmed, &probe) == nil && len(probe.Report) > 0 && string(probe.Report) != "null"
+}
+
+var statusMapping = map[string]courier.MsgStatusValue{
+	"Success":            courier.MsgDelivered,
+	"Sent":               courier.MsgSent,
+	"Buffered":           courier.MsgSent,
+	"Rejected":           courier.MsgFailed,
+	"Failed":             courier.MsgFailed,
+	"Expired":            courier.MsgFailed,
+	"DeliveredToNetwork": courier.MsgSent,
+	"DeliveredToHandset": courier.MsgDelivered,
+
+	// temporary failures which may succeed if we try again, errored so that they're retried
+	"SoftBounce":       courier.MsgErrored,
+	"Deferred":         courier.MsgErrored,
+	"TemporaryFailure": courier.MsgErrored,
+
+	// bridged channels like WhatsApp report when messages are read, which courier has no status for beyond delivered
+	"Read": courier.MsgDelivered,
+}
+
+// some accounts report statuses as numeric codes or as whether delivery succeeded, these are the statuses those map to
+var statusCodes = map[string]string{
+	"1":     "Success",
+	"2":     "Failed",
+	"4":     "Buffered",
+	"8":     "Sent",
+	"16":    "Rejected",
+	"32":    "Expired",
+	"true":  "Success",
+	"false": "Failed",
+}
+
+// knownStatuses returns the sorted names of the statuses we understand
+func knownStatuses() []string {
+	statuses := make([]string, 0, len(statusMapping))
+	for status := range statusMapping {
+		statuses = append(statuses, fmt.Sprintf("'%s'", status))
+	}
+	sort.Strings(statuses)
+	return statuses
+}
+
+// reasons for the error codes Mista includes on failed delivery reports, can be extended or overridden per channel
+var errorCodeReasons = map[string]string{
+	"1": "absent subscriber",
+	"2": "blacklisted",
+	"3": "invalid number",
+	"4": "network unreachable",
+	"5": "handset memory full",
+	"6": "rejected by operator",
+	"7": "insufficient balance",
+}
+
+// errorReason returns the human readable reason for the passed in delivery report error code
+func errorReason(channel courier.Channel, code string) string {
+	if reason, found := stringMapConfigForKey(channel, configErrorCodes)[code]; found {
+		return reason
+	}
+	if reason, found := errorCodeReasons[code]; found {
+		return reason
+	}
+	return "unknown error"
+}
+
+// receiveStatus is our HTTP handler function for status updates, which may be a single status or a batch
+func (h *handler) receiveStatus(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	writeAckHeaders(channel, w)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if isJSONArray(body) {
+		return h.receiveStatusBatch(ctx, channel, w, r, body)
+	}
+
+	// get our params
+	form := &statusForm{}
+	if isV2Status(channel, body) {
+		item := &statusItem{}
+		if err := json.Unmarshal(body, item); err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("unable to parse status: %w", err))
+		}
+		form = item.form()
+		err = handlers.Validate(form)
+	} else {
+		err = handlers.DecodeAndValidateForm(form, r)
+	}
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	// Mista sometimes sends the same status twice, which we acknowledge without writing it again
+	dedupKey, duplicate := h.isDuplicateStatus(channel, form)
+	if duplicate {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "duplicate status, ignored")
+	}
+
+	status, err := h.buildStatus(channel, form, r)
+	if err != nil {
+		h.statusDedup.release(dedupKey)
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	// some setups want us to confirm which status we processed rather than just that we accepted it
+	if channel.BoolConfigForKey(configEchoStatusAcks, false) {
+		err := h.Backend().WriteMsgStatus(ctx, status)
+		if err != nil {
+			h.statusDedup.release(dedupKey)
+		}
+		if err == courier.ErrMsgNotFound {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "message not found, ignored")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []courier.Event{status}, writeStatusAcks(ctx, w, []*statusAck{newStatusAck(form.ID, status)})
+	}
+
+	// write our status
+	events, err := handlers.WriteMsgStatusAndResponse(ctx, h, channel, status, w, r)
+	if err != nil {
+		h.statusDedup.release(dedupKey)
+	}
+	return events, err
+}
+
+// isDuplicateStatus returns whether the passed in status is one we've already received within the channel's dedup
+// window, along with the key it was deduplicated on, which is empty if the channel doesn't deduplicate statuses
+func (h *handler) isDuplicateStatus(channel courier.Channel, form *statusForm) (string, bool) {
+	window := channel.IntConfigForKey(configStatusDedupWindow, 0)
+	if window <= 0 {
+		return "", false
+	}
+
+	key := strings.Join([]string{channel.UUID().String(), normalizeUID(channel, form.ID), form.Status, form.Part}, "|")
+	return key, !h.statusDedup.reserve(key, time.Duration(window)*time.Second)
+}
+
+// statusAck is how we confirm a status we processed to setups which want it echoed back
+type statusAck struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func newStatusAck(id string, status courier.MsgStatus) *statusAck {
+	return &statusAck{ID: id, Status: string(status.Status())}
+}
+
+// writeStatusAcks writes a response echoing back the passed in processed statuses
+func writeStatusAcks(ctx context.Context, w http.ResponseWriter, acks []*statusAck) error {
+	data := make([]interface{}, len(acks))
+	for i, ack := range acks {
+		data[i] = ack
+	}
+	return courier.WriteDataResponse(ctx, w, http.StatusOK, "Status Update Accepted", data)
+}
+
+// receiveStatusBatch handles a batch of statuses posted as a JSON array, writing each status it can and only failing
+// the request if none of them could be written
+func (h *handler) receiveStatusBatch(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, body []byte) ([]courier.Event, error) {
+	items := make([]*statusItem, 0)
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("unable to parse status batch: %w", err))
+	}
+
+	statuses := make([]courier.MsgStatus, 0, len(items))
+	events := make([]courier.Event, 0, len(items))
+	acks := make([]*statusAck, 0, len(items))
+	failures := make([]string, 0)
+
+	for i, item := range items {
+		form := item.form()
+		err := handlers.Validate(form)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("item %d: %s", i, err))
+			continue
+		}
+
+		dedupKey, duplicate := h.isDuplicateStatus(channel, form)
+		if duplicate {
+			continue
+		}
+
+		status, err := h.buildStatus(channel, form, r)
+		if err != nil {
+			h.statusDedup.release(dedupKey)
+			failures = append(failures, fmt.Sprintf("item %d: %s", i, err))
+			continue
+		}
+
+		// statuses for messages we don't know about are skipped rather than failing the batch
+		if err := h.Backend().WriteMsgStatus(ctx, status); err != nil {
+			h.statusDedup.release(dedupKey)
+			failures = append(failures, fmt.Sprintf("item %d: %s", i, err))
+			continue
+		}
+
+		statuses = append(statuses, status)
+		events = append(events, status)
+		acks = append(acks, newStatusAck(form.ID, status))
+	}
+
+	if len(statuses) == 0 && len(failures) > 0 {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("no statuses written: %s", strings.Join(failures, ", ")))
+	}
+	if len(failures) > 0 {
+		logrus.WithField("channel_uuid", channel.UUID().String()).WithField("failures", failures).Warn("some statuses in batch not written")
+	}
+
+	if channel.BoolConfigForKey(configEchoStatusAcks, false) {
+		return events, writeStatusAcks(ctx, w, acks)
+	}
+	return events, courier.WriteStatusSuccess(ctx, w, r, statuses)
+}
+
+// buildStatus builds the status update described by the passed in form
+func (h *handler) buildStatus(channel courier.Channel, form *statusForm, r *http.Request) (courier.MsgStatus, error) {
+	form.ID = normalizeUID(channel, form.ID)
+
+	if _, found := statusMapping[form.Status]; !found {
+		if named, found := statusCodes[strings.ToLower(strings.TrimSpace(form.Status))]; found {
+			form.Status = named
+		}
+	}
+
+	msgStatus, found := statusMapping[form.Status]
+	if !found {
+		return nil, fmt.Errorf("unknown status '%s', must be one of %s", form.Status, strings.Join(knownStatuses(), ", "))
+	}
+
+	// some operators buffer messages they haven't yet tried to deliver, so channels can treat those as still pending
+	if form.Status == "Buffered" {
+		switch buffered := channel.StringConfigForKey(configBufferedStatus, bufferedStatusSent); buffered {
+		case bufferedStatusSent:
+			msgStatus = courier.MsgSent
+		case bufferedStatusWired:
+			msgStatus = courier.MsgWired
+		default:
+			return nil, fmt.Errorf("unknown buffered status '%s', must be one of '%s' or '%s'", buffered, bufferedStatusSent, bufferedStatusWired)
+		}
+	}
+
+	// a success only confirmed by the network isn't delivered until the handset confirms it too
+	if msgStatus == courier.MsgDelivered && strings.EqualFold(form.DeliveredTo, "network") {
+		msgStatus = courier.MsgSent
+	}
+
+	// accounts which allow re-sending expired messages can have them errored so that they're retried
+	expired := form.Status == "Expired"
+	if expired && channel.BoolConfigForKey(configRetryExpired, false) {
+		msgStatus = courier.MsgErrored
+	}
+
+	// failures with codes the channel knows are temporary are soft bounces too, and channels which don't want soft
+	// bounces retried can have them failed instead
+	softBounce := msgStatus == courier.MsgErrored && !expired
+	if msgStatus == courier.MsgFailed && isSoftBounceCode(channel, form.ErrorCode) {
+		msgStatus = courier.MsgErrored
+		softBounce = true
+	}
+	if softBounce && channel.BoolConfigForKey(configFailSoftBounces, false) {
+		msgStatus = courier.MsgFailed
+	}
+
+	// prefer matching on our own reference if Mista gave it back to us, as long as it looks like one of our IDs
+	var status courier.MsgStatus
+	msgID, err := parseReference(form.Reference)
+	if err != nil && channel.BoolConfigForKey(configValidateReference, true) {
+		return nil, err
+	}
+
+	part, partErr := strconv.Atoi(form.Part)
+	parts, partsErr := strconv.Atoi(form.Parts)
+	knownPart := partErr == nil && partsErr == nil
+
+	// without a reference we can still tie the status of any part of a message we sent recently back to it by its UID
+	if msgID == courier.NilMsgID {
+		if sent, found := h.recentUIDs.lookup(channel, form.ID); found {
+			msgID = sent.msgID
+			if !knownPart {
+				part, parts, knownPart = sent.part, sent.parts, true
+			}
+		}
+	}
+
+	// each part of a multipart message gets its own status, which we can combine into the status of the whole message
+	if msgID != courier.NilMsgID && channel.BoolConfigForKey(configAggregateParts, false) && knownPart && parts > 1 {
+		msgStatus = h.parts.record(channel.UUID().String()+":"+msgID.String(), part, parts, msgStatus)
+	}
+
+	if msgID != courier.NilMsgID {
+		status = h.Backend().NewMsgStatusForID(channel, msgID, msgStatus)
+	} else {
+		status = h.Backend().NewMsgStatusForExternalID(channel, form.ID, msgStatus)
+	}
+
+	// measure how long delivery took for messages we sent recently
+	if latency := h.latencyLog(channel, msgID, form.ID, msgStatus); latency != nil {
+		status.AddLog(latency)
+	}
+
+	// record why the delivery failed if we were told
+	if softBounce {
+		status.AddLog(courier.NewChannelLogFromError("Soft Bounce", channel, courier.NilMsgID, 0, fmt.Errorf("temporary delivery failure '%s'", form.Status)))
+	}
+	if expired {
+		status.AddLog(courier.NewChannelLogFromError("Message Expired", channel, courier.NilMsgID, 0, errors.New("expired before delivery")))
+	}
+	if form.ErrorCode != "" {
+		reason := firstNonEmpty(form.ErrorMessage, errorReason(channel, form.ErrorCode))
+		status.AddLog(courier.NewChannelLogFromError("Message Failed", channel, courier.NilMsgID, 0, fmt.Errorf("%s (error code %s)", reason, form.ErrorCode)))
+	} else if form.ErrorMessage != "" {
+		status.AddLog(courier.NewChannelLogFromError("Message Failed", channel, courier.NilMsgID, 0, errors.New(form.ErrorMessage)))
+	}
+
+	// surface any metadata Mista echoed back to us so it can be correlated with what we sent
+	if form.Metadata != "" {
+		status.AddLog(courier.NewChannelLog("Metadata Received", channel, courier.NilMsgID, r.Method, r.URL.String(), http.StatusOK, form.Metadata, "", 0, nil))
+	}
+
+	return status, nil
+}
+
+// isSoftBounceCode returns whether the passed in delivery report error code is one the channel considers temporary
+func isSoftBounceCode(channel courier.Channel, code string) bool {
+	for _, c := range stringListConfigForKey(channel, configSoftBounceCodes) {
+		if code != "" && c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReference parses the client reference on a status callback as a message ID, returning NilMsgID if there is
+// no reference and an error if it isn't a valid message ID
+func parseReference(reference string) (courier.MsgID, error) {
+	reference = strings.TrimSpace(reference)
+	if reference == "" {
+		return courier.NilMsgID, nil
+	}
+
+	id, err := strconv.ParseInt(reference, 10, 64)
+	if err != nil || id <= 0 {
+		return courier.NilMsgID, fmt.Errorf("invalid reference '%s', must be a message ID", reference)
+	}
+	return courier.MsgID(id), nil
+}
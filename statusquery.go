@@ -0,0 +1,48 @@
+package mista
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+)
+
+// FetchMsgStatus asks Mista for the current status of the message with the passed in UID and writes it, so that
+// messages whose delivery reports never arrived can still be brought up to date
+func (h *handler) FetchMsgStatus(ctx context.Context, channel courier.Channel, uid string) (courier.MsgStatus, error) {
+	if uid == "" {
+		return nil, errors.New("can't fetch status of message without a UID")
+	}
+
+	url := endpointURL(channel, endpointStatus, map[string]string{"uid": uid})
+	item := &statusItem{}
+	if err := h.callAPI(ctx, channel, http.MethodGet, url, nil, item); err != nil {
+		return nil, fmt.Errorf("error fetching message status: %w", err)
+	}
+
+	// the response is in the same format as the statuses Mista posts to us, but needn't repeat the UID we asked for
+	form := item.form()
+	if form.ID == "" {
+		form.ID = uid
+	}
+	if err := handlers.Validate(form); err != nil {
+		return nil, fmt.Errorf("invalid message status: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	status, err := h.buildStatus(channel, form, r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message status: %w", err)
+	}
+
+	if err := h.Backend().WriteMsgStatus(ctx, status); err != nil {
+		return nil, fmt.Errorf("error writing message status: %w", err)
+	}
+	return status, nil
+}
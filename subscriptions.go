@@ -0,0 +1,109 @@
+package mista
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+// the Mista webhook events we serve and the actions of our routes which serve them
+var subscribedEvents = map[string]string{
+	"inbound": "receive",
+	"dlr":     "status",
+	"ussd":    "ussd",
+}
+
+// how long we give reconciling the subscriptions of a channel
+const reconcileTimeout = 30 * time.Second
+
+// subscription is a Mista webhook event subscription
+type subscription struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event"`
+	URL   string `json:"url"`
+}
+
+// callbackURL returns the URL of our route for the passed in action on a channel
+func (h *handler) callbackURL(channel courier.Channel, action string) string {
+	domain := channel.CallbackDomain(h.Server().Config().Domain)
+	return fmt.Sprintf("https://%s/c/%s/%s/%s", domain, strings.ToLower(channel.ChannelType().String()), channel.UUID(), action)
+}
+
+// ReconcileSubscriptions makes sure the Mista account of the passed in channel is subscribed to the webhook events we
+// serve at our URLs for them, creating or updating subscriptions as needed. Subscriptions to events we don't serve
+// are left alone, and nothing is changed if everything is already as it should be.
+func (h *handler) ReconcileSubscriptions(ctx context.Context, channel courier.Channel) error {
+	var existing struct {
+		Subscriptions []*subscription `json:"subscriptions"`
+	}
+	if err := h.callAPI(ctx, channel, http.MethodGet, endpointURL(channel, endpointSubscriptions, nil), nil, &existing); err != nil {
+		return fmt.Errorf("error fetching subscriptions: %w", err)
+	}
+
+	byEvent := make(map[string]*subscription, len(existing.Subscriptions))
+	for _, s := range existing.Subscriptions {
+		byEvent[s.Event] = s
+	}
+
+	log := logrus.WithField("channel_uuid", channel.UUID().String())
+
+	for event, action := range subscribedEvents {
+		url := h.callbackURL(channel, action)
+		current := byEvent[event]
+
+		switch {
+		case current == nil:
+			if err := h.callAPI(ctx, channel, http.MethodPost, endpointURL(channel, endpointSubscriptions, nil), &subscription{Event: event, URL: url}, nil); err != nil {
+				return fmt.Errorf("error subscribing to '%s' events: %w", event, err)
+			}
+			log.WithField("event", event).WithField("url", url).Info("subscribed to Mista events")
+
+		case current.URL != url:
+			subscriptionURL := endpointURL(channel, endpointSubscription, map[string]string{"id": current.ID})
+			if err := h.callAPI(ctx, channel, http.MethodPut, subscriptionURL, &subscription{Event: event, URL: url}, nil); err != nil {
+				return fmt.Errorf("error updating subscription to '%s' events: %w", event, err)
+			}
+			log.WithField("event", event).WithField("old_url", current.URL).WithField("url", url).Info("updated subscription to Mista events")
+		}
+	}
+	return nil
+}
+
+// withSubscriptions wraps the passed in route handler so that the subscriptions of channels which have us manage them
+// are reconciled when they're first used. We have no way of knowing which channels there are when we're initialized,
+// so this is as close to startup as we can get.
+func (h *handler) withSubscriptions(fn courier.ChannelHandleFunc) courier.ChannelHandleFunc {
+	return func(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+		h.reconcileOnce(channel)
+		return fn(ctx, channel, w, r)
+	}
+}
+
+// reconcileOnce reconciles the subscriptions of the passed in channel in the background, if it has us manage them and
+// we haven't already done so. Failures are logged rather than failing whatever the channel is being used for, and are
+// tried again the next time it's used.
+func (h *handler) reconcileOnce(channel courier.Channel) {
+	if !channel.BoolConfigForKey(configManageSubscriptions, false) {
+		return
+	}
+
+	key := channel.UUID().String()
+	if _, reconciled := h.reconciled.LoadOrStore(key, true); reconciled {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+		defer cancel()
+
+		if err := h.ReconcileSubscriptions(ctx, channel); err != nil {
+			h.reconciled.Delete(key)
+			logrus.WithField("channel_uuid", key).WithError(err).Error("error reconciling Mista subscriptions")
+		}
+	}()
+}
@@ -0,0 +1,40 @@
+package mista
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/nyaruka/courier"
+)
+
+// default number of seconds we suppress sends to a blocked recipient for
+const defaultSuppressionTTL = 24 * 60 * 60
+
+// matches Mista rejections because the recipient has blocked us or is on a do-not-disturb registry, which must say
+// it's the recipient that's blocked as rejections of our sender can use the same words
+var blockedRecipientRegex = regexp.MustCompile(`(?i)\b(recipient|number|subscriber|msisdn|destination)\b.*\b(blocked|blacklisted|barred|opted[ -]out)\b|\b(dnd|do not disturb)\b`)
+
+// suppressionKey returns the key we suppress the passed in recipient for a channel under
+func suppressionKey(channel courier.Channel, recipient string) string {
+	return channel.UUID().String() + ":" + recipient
+}
+
+// suppress stops sends to the passed in recipient for the channel's suppression TTL
+func (h *handler) suppress(channel courier.Channel, recipient string) {
+	ttl := time.Duration(channel.IntConfigForKey(configSuppressionTTL, defaultSuppressionTTL)) * time.Second
+	h.suppressed.Store(suppressionKey(channel, recipient), time.Now().Add(ttl))
+}
+
+// isSuppressed returns whether sends to the passed in recipient are currently suppressed
+func (h *handler) isSuppressed(channel courier.Channel, recipient string) bool {
+	key := suppressionKey(channel, recipient)
+	expires, found := h.suppressed.Load(key)
+	if !found {
+		return false
+	}
+	if time.Now().After(expires.(time.Time)) {
+		h.suppressed.Delete(key)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package mista
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+// tokenBucket limits sends to a sustained rate per second, while allowing bursts of up to its capacity after quieter
+// periods
+type tokenBucket struct {
+	mutex    sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, capacity int) *tokenBucket {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenBucket{rate: rate, capacity: float64(capacity), tokens: float64(capacity), last: time.Now()}
+}
+
+// reserve takes a token from the bucket, returning how long the caller must wait before it can be used
+func (b *tokenBucket) reserve() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back a token which was reserved but not used
+func (b *tokenBucket) cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens = math.Min(b.capacity, b.tokens+1)
+}
+
+// wait blocks until a token is available or the passed in context is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	delay := b.reserve()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
+
+// take takes a token from the bucket if one is available now, otherwise returning how long until one will be
+func (b *tokenBucket) take() (bool, time.Duration) {
+	delay := b.reserve()
+	if delay == 0 {
+		return true, 0
+	}
+	b.cancel()
+	return false, delay
+}
+
+// throttle blocks until the passed in channel's rate limit allows another send, channels without a configured rate
+// aren't limited at all
+func (h *handler) throttle(ctx context.Context, channel courier.Channel) error {
+	rate, _ := floatConfigForKey(channel, configSendRate)
+	if rate <= 0 {
+		return nil
+	}
+	burst := channel.IntConfigForKey(configSendBurst, 1)
+
+	// buckets are keyed by their config too so that changes to it take effect
+	key := fmt.Sprintf("%s:%g:%d", channel.UUID(), rate, burst)
+	bucket, _ := h.throttles.LoadOrStore(key, newTokenBucket(rate, burst))
+
+	return bucket.(*tokenBucket).wait(ctx)
+}
+
+// allowReceive returns whether the passed in channel's inbound rate limit allows another incoming message, and if not
+// how long until it will. Channels without a configured rate aren't limited at all.
+func (h *handler) allowReceive(channel courier.Channel) (bool, time.Duration) {
+	rate, _ := floatConfigForKey(channel, configReceiveRate)
+	if rate <= 0 {
+		return true, 0
+	}
+	burst := channel.IntConfigForKey(configReceiveBurst, 1)
+
+	key := fmt.Sprintf("receive:%s:%g:%d", channel.UUID(), rate, burst)
+	bucket, _ := h.throttles.LoadOrStore(key, newTokenBucket(rate, burst))
+
+	return bucket.(*tokenBucket).take()
+}
+
+// writeThrottled rejects an incoming request which is over the channel's inbound rate limit, telling Mista when it
+// can try again
+func (h *handler) writeThrottled(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, retryAfter time.Duration) error {
+	err := fmt.Errorf("inbound rate limit exceeded, retry after %s", retryAfter.Round(time.Millisecond))
+	log := courier.NewChannelLog("Receive Throttled", channel, courier.NilMsgID, r.Method, r.URL.String(), http.StatusTooManyRequests, "", "", 0, err)
+	if err := h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log}); err != nil {
+		logrus.WithField("channel_uuid", channel.UUID().String()).WithError(err).Error("error writing throttled log")
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return courier.WriteDataResponse(ctx, w, http.StatusTooManyRequests, err.Error(), nil)
+}
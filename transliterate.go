@@ -0,0 +1,48 @@
+package mista
+
+import (
+	"strings"
+
+	"github.com/nyaruka/gocommon/gsm7"
+)
+
+// close GSM7 equivalents for characters which aren't part of the GSM7 charset
+var gsm7Transliterations = map[rune]string{
+	'á': "a", 'â': "a", 'ã': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'Á': "A", 'Â': "A", 'Ã': "A", 'À': "A", 'Ā': "A", 'Ă': "A", 'Ą': "A",
+	'ç': "c", 'ć': "c", 'č': "c", 'Ć': "C", 'Č': "C",
+	'ď': "d", 'Ď': "D", 'đ': "d", 'Đ': "D",
+	'ê': "e", 'ë': "e", 'ē': "e", 'ę': "e", 'ě': "e",
+	'È': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E", 'Ę': "E", 'Ě': "E",
+	'ğ': "g", 'Ğ': "G",
+	'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ī': "I", 'İ': "I",
+	'ł': "l", 'Ł': "L",
+	'ń': "n", 'ň': "n", 'Ń': "N", 'Ň': "N",
+	'ó': "o", 'ô': "o", 'õ': "o", 'ō': "o", 'ő': "ö",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ō': "O", 'Ő': "Ö",
+	'ř': "r", 'Ř': "R",
+	'ś': "s", 'ş': "s", 'š': "s", 'Ś': "S", 'Ş': "S", 'Š': "S",
+	'ť': "t", 'ţ': "t", 'Ť': "T", 'Ţ': "T",
+	'ú': "u", 'û': "u", 'ū': "u", 'ů': "u", 'ű': "ü",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ū': "U", 'Ů': "U", 'Ű': "Ü",
+	'ý': "y", 'ÿ': "y", 'Ý': "Y", 'Ÿ': "Y",
+	'ź': "z", 'ż': "z", 'ž': "z", 'Ź': "Z", 'Ż': "Z", 'Ž': "Z",
+	'œ': "oe", 'Œ': "OE",
+}
+
+// transliterate replaces any characters outside of the GSM7 charset with their closest GSM7 equivalents, returning
+// the result and whether it can now be sent as GSM7
+func transliterate(text string) (string, bool) {
+	var b strings.Builder
+	for _, r := range text {
+		if replacement, found := gsm7Transliterations[r]; found {
+			b.WriteString(replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	transliterated := gsm7.ReplaceSubstitutions(b.String())
+	return transliterated, gsm7.IsValid(transliterated)
+}
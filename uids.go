@@ -0,0 +1,78 @@
+package mista
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/nyaruka/courier"
+)
+
+// number of recently sent UIDs we remember to detect Mista reusing them
+const recentUIDsSize = 10000
+
+// uidCache remembers which message and part of it the most recent UIDs Mista gave us belong to, evicting the oldest
+// once full
+type uidCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]sentPart
+	order   []string
+}
+
+// sentPart is the part of a message Mista gave a UID to, parts being numbered from 1 as Mista numbers them
+type sentPart struct {
+	msgID courier.MsgID
+	part  int
+	parts int
+}
+
+func newUIDCache(size int) *uidCache {
+	return &uidCache{size: size, entries: make(map[string]sentPart, size)}
+}
+
+// record records the passed in UID as belonging to the given part of a message, returning the ID of any other recent
+// message it already belonged to, or NilMsgID
+func (c *uidCache) record(channel courier.Channel, uid string, msgID courier.MsgID, part, parts int) courier.MsgID {
+	key := channel.UUID().String() + ":" + uid
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if existing, found := c.entries[key]; found {
+		if existing.msgID != msgID {
+			return existing.msgID
+		}
+		return courier.NilMsgID
+	}
+
+	if len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = sentPart{msgID: msgID, part: part, parts: parts}
+	c.order = append(c.order, key)
+	return courier.NilMsgID
+}
+
+// lookup returns the part of a message the passed in UID was recently given to, if we remember it
+func (c *uidCache) lookup(channel courier.Channel, uid string) (sentPart, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	sent, found := c.entries[channel.UUID().String()+":"+uid]
+	return sent, found
+}
+
+// normalizeUID normalizes the passed in UID as Mista gave it to us, either on a send or a status, so that both match.
+// Some accounts pad their UIDs with whitespace or prefix them in some responses but not others.
+func normalizeUID(channel courier.Channel, uid string) string {
+	if !channel.BoolConfigForKey(configNormalizeUIDs, false) {
+		return uid
+	}
+
+	uid = strings.TrimSpace(uid)
+	if prefix := channel.StringConfigForKey(configUIDPrefix, ""); prefix != "" {
+		uid = strings.TrimSpace(strings.TrimPrefix(uid, prefix))
+	}
+	return uid
+}
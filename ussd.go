@@ -0,0 +1,71 @@
+package mista
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+)
+
+type ussdForm struct {
+	SessionID string `validate:"required" name:"session_id"`
+	Event     string `validate:"required" name:"event"`
+	From      string `validate:"required" name:"from"`
+	To        string `name:"to"`
+	Text      string `name:"text"`
+	Code      string `name:"service_code"`
+}
+
+// the events Mista sends over the lifetime of a USSD session
+const (
+	ussdEventStart    = "start"
+	ussdEventContinue = "continue"
+	ussdEventEnd      = "end"
+)
+
+// receiveUSSD is our HTTP handler function for USSD session events
+func (h *handler) receiveUSSD(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	form := &ussdForm{}
+	err := handlers.DecodeAndValidateForm(form, r)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	urn, err := handlers.StrictTelForCountry(form.From, channel.Country())
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	urn, err = pseudonymize(channel, urn)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	switch strings.ToLower(form.Event) {
+	case ussdEventStart:
+		// a new session is a new conversation, started via the dialed service code
+		event := h.Backend().NewChannelEvent(channel, courier.NewConversation, urn).WithExtra(map[string]interface{}{
+			"session_id":   form.SessionID,
+			"service_code": form.Code,
+		})
+		return handlers.WriteChannelEventAndResponse(ctx, h, channel, event, w, r)
+
+	case ussdEventContinue:
+		// each response within the session is an incoming message tied to the session
+		metadata, err := json.Marshal(map[string]interface{}{"session_id": form.SessionID})
+		if err != nil {
+			return nil, err
+		}
+		msg := h.Backend().NewIncomingMsg(channel, urn, form.Text).WithMetadata(metadata)
+		return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+
+	case ussdEventEnd:
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "ignoring USSD session end")
+	}
+
+	return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r,
+		fmt.Errorf("unknown USSD event '%s', must be one of 'start', 'continue' or 'end'", form.Event))
+}
@@ -0,0 +1,48 @@
+package mista
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/nyaruka/courier"
+)
+
+// SendVerificationCode asks Mista to send a one-time code to the passed in channel's number so that whoever is claiming
+// the channel can prove they own it, returning the ID of the verification to confirm the code against
+func (h *handler) SendVerificationCode(ctx context.Context, channel courier.Channel) (string, error) {
+	payload := map[string]string{"phone_number": channel.Address()}
+
+	var response struct {
+		VerificationID string `json:"verification_id"`
+	}
+	if err := h.callAPI(ctx, channel, http.MethodPost, endpointURL(channel, endpointVerify, nil), payload, &response); err != nil {
+		return "", fmt.Errorf("error requesting verification code: %w", err)
+	}
+	if response.VerificationID == "" {
+		return "", errors.New("verification response missing verification_id")
+	}
+	return response.VerificationID, nil
+}
+
+// VerifyCode confirms the one-time code entered for the passed in verification, returning whether it was correct
+func (h *handler) VerifyCode(ctx context.Context, channel courier.Channel, verificationID string, code string) (bool, error) {
+	url := endpointURL(channel, endpointConfirm, map[string]string{"verification_id": verificationID})
+	payload := map[string]string{"code": code}
+
+	var response struct {
+		Verified bool `json:"verified"`
+	}
+	err := h.callAPI(ctx, channel, http.MethodPost, url, payload, &response)
+
+	// Mista rejects incorrect codes outright, which isn't an error on our part
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && (apiErr.statusCode == http.StatusBadRequest || apiErr.statusCode == http.StatusUnprocessableEntity) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error confirming verification code: %w", err)
+	}
+	return response.Verified, nil
+}